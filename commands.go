@@ -0,0 +1,384 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FreekingDean/docker-machine-driver-proxmoxve/driver"
+)
+
+type command struct {
+	usage string
+	run   func(fs *flag.FlagSet, storePath *string, args []string) error
+}
+
+var commands = map[string]command{
+	"migrate": {
+		usage: "migrate [flags] MACHINE [NODE]",
+		run:   migrateCommand,
+	},
+	"suspend": {
+		usage: "suspend [flags] MACHINE",
+		run:   suspendCommand,
+	},
+	"resume": {
+		usage: "resume [flags] MACHINE",
+		run:   resumeCommand,
+	},
+	"backup": {
+		usage: "backup create|restore [flags] MACHINE [VOLUME]",
+		run:   backupCommand,
+	},
+	"snapshot": {
+		usage: "snapshot create|list|rollback|delete [flags] MACHINE [NAME]",
+		run:   snapshotCommand,
+	},
+	"finish-create": {
+		usage: "finish-create [flags] MACHINE",
+		run:   finishCreateCommand,
+	},
+	"exec": {
+		usage: "exec [flags] MACHINE COMMAND...",
+		run:   execCommand,
+	},
+	"reconcile": {
+		usage: "reconcile [flags]",
+		run:   reconcileCommand,
+	},
+	"pin-host-key": {
+		usage: "pin-host-key [flags] MACHINE",
+		run:   pinHostKeyCommand,
+	},
+	"push": {
+		usage: "push [flags] MACHINE LOCAL REMOTE",
+		run:   pushCommand,
+	},
+	"upgrade": {
+		usage: "upgrade [flags] MACHINE",
+		run:   upgradeCommand,
+	},
+}
+
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command '%s', expected one of:\n%s", name, usage())
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n", filepath.Base(os.Args[0]), cmd.usage)
+		fs.PrintDefaults()
+	}
+	storePath := fs.String("storage-path", defaultStorePath(), "docker-machine storage path")
+	return cmd.run(fs, storePath, args)
+}
+
+func usage() string {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := ""
+	for _, name := range names {
+		out += fmt.Sprintf("  %s\n", commands[name].usage)
+	}
+	return out
+}
+
+func defaultStorePath() string {
+	if p := os.Getenv("MACHINE_STORAGE_PATH"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "machine")
+}
+
+func migrateCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	withLocalDisks := fs.Bool("with-local-disks", false, "migrate local disks along with the VM")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a machine name and optional target node")
+	}
+
+	d, err := driver.LoadMachine(*storePath, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	err = d.Migrate(fs.Arg(1), *withLocalDisks)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is now on %s\n", d.GetMachineName(), d.Node)
+	return d.SaveMachine()
+}
+
+// loadMachine parses the flags of a command taking a single machine argument
+// and loads that machine
+func loadMachine(fs *flag.FlagSet, storePath *string, args []string) (*driver.Driver, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return nil, fmt.Errorf("expected a machine name")
+	}
+	return driver.LoadMachine(*storePath, fs.Arg(0))
+}
+
+func suspendCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	toDisk := fs.Bool("to-disk", false, "save the VM state to disk and stop it instead of pausing it in RAM")
+	stateStorage := fs.String("state-storage", "", "storage to save the VM state to when suspending to disk")
+	d, err := loadMachine(fs, storePath, args)
+	if err != nil {
+		return err
+	}
+	return d.Suspend(*toDisk, *stateStorage)
+}
+
+func resumeCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	d, err := loadMachine(fs, storePath, args)
+	if err != nil {
+		return err
+	}
+	return d.Start()
+}
+
+func snapshotCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	withRAM := fs.Bool("with-ram", false, "include RAM in the snapshot (create)")
+	freezeFS := fs.Bool("freeze-fs", false, "require the guest agent so filesystems are frozen while snapshotting, not with --with-ram (create)")
+	description := fs.String("description", "", "snapshot description (create)")
+	if len(args) < 1 {
+		fs.Usage()
+		return fmt.Errorf("expected an action")
+	}
+	action := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	wantArgs := 2
+	if action == "list" {
+		wantArgs = 1
+	}
+	if fs.NArg() != wantArgs {
+		fs.Usage()
+		return fmt.Errorf("expected %d arguments for %s", wantArgs, action)
+	}
+	d, err := driver.LoadMachine(*storePath, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "create":
+		return d.CreateSnapshot(fs.Arg(1), *description, *withRAM, *freezeFS)
+	case "rollback":
+		return d.RollbackSnapshot(fs.Arg(1))
+	case "delete":
+		return d.DeleteSnapshot(fs.Arg(1))
+	case "list":
+		snaps, err := d.ListSnapshots()
+		if err != nil {
+			return err
+		}
+		for _, snap := range snaps {
+			created := ""
+			if snap.Snaptime != nil {
+				created = time.Unix(int64(*snap.Snaptime), 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\t%s\n", snap.Name, created, snap.Description)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown snapshot action '%s'", action)
+}
+
+func backupCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	storage := fs.String("storage", "", "storage to back up to (create) or restore disks onto (restore)")
+	mode := fs.String("mode", "snapshot", "backup mode: snapshot, suspend or stop (create)")
+	switchVM := fs.Bool("switch", false, "point the machine at the restored VM and stop the old one (restore)")
+	removeOld := fs.Bool("remove-old", false, "remove the old VM when switching (restore)")
+	if len(args) < 1 {
+		fs.Usage()
+		return fmt.Errorf("expected an action")
+	}
+	action := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	wantArgs := 1
+	if action == "restore" {
+		wantArgs = 2
+	}
+	if fs.NArg() != wantArgs {
+		fs.Usage()
+		return fmt.Errorf("expected %d arguments for %s", wantArgs, action)
+	}
+	d, err := driver.LoadMachine(*storePath, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "create":
+		return d.Backup(*storage, *mode)
+	case "restore":
+		id, err := d.Restore(fs.Arg(1), *storage)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored %s into VM %d on %s\n", fs.Arg(1), id, d.Node)
+		if !*switchVM {
+			return nil
+		}
+		err = d.SwitchVM(id, *removeOld)
+		if err != nil {
+			return err
+		}
+		return d.SaveMachine()
+	}
+	return fmt.Errorf("unknown backup action '%s'", action)
+}
+
+func execCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	channel := fs.String("channel", "", "run over ssh or agent instead of the machine's command channel")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a machine name and a command")
+	}
+	d, err := driver.LoadMachine(*storePath, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *channel != "" {
+		d.CommandChannel = *channel
+	}
+	out, err := d.RunCommand(strings.Join(fs.Args()[1:], " "))
+	fmt.Print(out)
+	return err
+}
+
+func pushCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return fmt.Errorf("expected a machine name, a local file and a remote path")
+	}
+	d, err := driver.LoadMachine(*storePath, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	return d.PushFile(fs.Arg(2), content)
+}
+
+func pinHostKeyCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	d, err := loadMachine(fs, storePath, args)
+	if err != nil {
+		return err
+	}
+	if err := d.PinHostKey(); err != nil {
+		return err
+	}
+	return d.SaveMachine()
+}
+
+func finishCreateCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	d, err := loadMachine(fs, storePath, args)
+	if err != nil {
+		return err
+	}
+	if err := d.Create(); err != nil {
+		return err
+	}
+	fmt.Printf("%s is created, run docker-machine provision %s to set up docker\n", d.GetMachineName(), d.GetMachineName())
+	return d.SaveMachine()
+}
+
+func upgradeCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	d, err := loadMachine(fs, storePath, args)
+	if err != nil {
+		return err
+	}
+	if err := d.Upgrade(); err != nil {
+		return err
+	}
+	// the reboot may have moved the machine to another IP
+	return d.SaveMachine()
+}
+
+func reconcileCommand(fs *flag.FlagSet, storePath *string, args []string) error {
+	from := fs.String("from", "", "machine to take the Proxmox VE connection and pool from")
+	host := fs.String("host", os.Getenv("PROXMOXVE_PROXMOX_HOST"), "Proxmox VE host")
+	user := fs.String("user", os.Getenv("PROXMOXVE_PROXMOX_USER_NAME"), "Proxmox VE user")
+	realm := fs.String("realm", envOr("PROXMOXVE_PROXMOX_REALM", "pam"), "Proxmox VE realm")
+	pool := fs.String("pool", os.Getenv("PROXMOXVE_PROXMOX_POOL"), "pool to look for orphans in, the whole cluster if empty")
+	dryRun := fs.Bool("dry-run", true, "only report orphans, set to false to delete them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments")
+	}
+
+	var d *driver.Driver
+	if *from != "" {
+		var err error
+		d, err = driver.LoadMachine(*storePath, *from)
+		if err != nil {
+			return err
+		}
+	} else {
+		d = driver.NewDriver("", *storePath).(*driver.Driver)
+		d.Host = *host
+		d.User = *user
+		d.Realm = *realm
+		d.Password = os.Getenv("PROXMOXVE_PROXMOX_USER_PASSWORD")
+		d.Pool = *pool
+	}
+
+	orphans, err := d.FindOrphans(*storePath)
+	if err != nil {
+		return err
+	}
+	for _, o := range orphans {
+		action := "orphan"
+		if !*dryRun {
+			action = "deleted"
+			if err := d.RemoveOrphan(o); err != nil {
+				return fmt.Errorf("could not delete vm %d: %w", o.VMID, err)
+			}
+		}
+		fmt.Printf("%s\t%d\t%s\t%s\t%s\n", action, o.VMID, o.Node, o.Name, o.MachineID)
+	}
+	return nil
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
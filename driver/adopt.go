@@ -0,0 +1,231 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/labstack/gommon/log"
+)
+
+// adopt takes over the existing VM named by Adopt instead of creating one,
+// tagging it as the machine's and starting it if needed. Should adopting fail
+// after tagging, the VM is handed back with its original tags, and stopped if
+// adopt started it.
+func (d *Driver) adopt(ctx context.Context) (err error) {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	resources, err := cluster.New(c).Resources(ctx, cluster.ResourcesRequest{
+		Type: cluster.PtrType(cluster.Type_VM),
+	})
+	if err != nil {
+		return err
+	}
+	vm, err := adoptTarget(resources, d.Adopt)
+	if err != nil {
+		return err
+	}
+	d.VMID = *vm.Vmid
+	d.Node = *vm.Node
+	if vm.Name != nil && *vm.Name != d.GetMachineName() {
+		d.VMName = *vm.Name
+	}
+	log.Infof("Adopting VM %d on %s", d.VMID, d.Node)
+
+	if d.MachineID == "" {
+		d.MachineID, err = newMachineID()
+		if err != nil {
+			return err
+		}
+	}
+	tags, err := d.tagVM(ctx)
+	if err != nil {
+		return err
+	}
+	started := false
+	defer func() {
+		if err != nil {
+			d.release(tags, started)
+		}
+	}()
+	// a tagged VM no machine claims is an orphan to reconcile, so claim it
+	// before anything can interrupt the adoption
+	err = d.SaveMachine()
+	if err != nil {
+		return fmt.Errorf("could not record vm %d in the machine store: %w", d.VMID, err)
+	}
+
+	key, err := d.generateKey()
+	if err != nil {
+		return err
+	}
+
+	st, err := d.GetState()
+	if err != nil {
+		return err
+	}
+	if st != state.Running {
+		err = d.start(ctx)
+		if err != nil {
+			return err
+		}
+		started = true
+	}
+
+	err = d.waitForNetwork(ctx)
+	if err != nil {
+		return err
+	}
+
+	if d.AdoptInjectKey {
+		err = d.injectKey(key)
+		if err != nil {
+			return fmt.Errorf("could not inject ssh key: %w", err)
+		}
+	}
+	err = d.PinHostKey()
+	if err != nil {
+		log.Warnf("Could not pin the host key of VM %d: %v", d.VMID, err)
+	}
+	if d.Protection {
+		return d.protect(ctx)
+	}
+	return nil
+}
+
+// release hands the VM of a failed adopt back, restoring its original tags
+// and stopping it if adopt started it
+func (d *Driver) release(tags string, started bool) {
+	// ctx may be what ended the adopt, clean up with a fresh one
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if started {
+		err := d.Stop()
+		if err != nil {
+			log.Warnf("Could not stop VM %d again: %v", d.VMID, err)
+		}
+	}
+	c, err := d.EnsureClient()
+	if err == nil {
+		req := qemu.UpdateVmConfigRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+		}
+		if tags == "" {
+			req.Delete = proxmox.String("tags")
+		} else {
+			req.Tags = proxmox.String(tags)
+		}
+		err = d.withVMNode(func() error {
+			return qemu.New(c).UpdateVmConfig(ctx, req)
+		})
+	}
+	if err != nil {
+		log.Warnf("Could not restore the tags '%s' of VM %d: %v", tags, d.VMID, err)
+	}
+	d.VMID = 0
+	err = d.SaveMachine()
+	if err != nil {
+		log.Warnf("Could not update the machine store: %v", err)
+	}
+}
+
+// adoptTarget finds the qemu VM with the VMID or name adopt
+func adoptTarget(resources []cluster.ResourcesResponse, adopt string) (cluster.ResourcesResponse, error) {
+	vmid, err := strconv.Atoi(adopt)
+	byID := err == nil
+
+	matches := []cluster.ResourcesResponse{}
+	for _, r := range resources {
+		if r.Type != cluster.Type_QEMU || r.Vmid == nil || r.Node == nil {
+			continue
+		}
+		if byID && *r.Vmid == vmid || !byID && r.Name != nil && *r.Name == adopt {
+			matches = append(matches, r)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return cluster.ResourcesResponse{}, fmt.Errorf("no VM '%s' to adopt", adopt)
+	case 1:
+		return matches[0], nil
+	}
+	return cluster.ResourcesResponse{}, fmt.Errorf("%d VMs are named '%s', adopt one by VMID", len(matches), adopt)
+}
+
+// tagVM adds the driver and machine ID tags to the VM's existing tags,
+// returning the tags it had before. A VM already tagged by the driver belongs
+// to another machine and is refused.
+func (d *Driver) tagVM(ctx context.Context) (string, error) {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return "", err
+	}
+	q := qemu.New(c)
+	cfg, err := q.VmConfig(ctx, qemu.VmConfigRequest{
+		Node: d.Node,
+		Vmid: d.VMID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	orig := ""
+	if cfg.Tags != nil {
+		orig = *cfg.Tags
+	}
+	if id := tagMachineID(orig); id != "" && id != d.MachineID {
+		return "", fmt.Errorf("vm %d belongs to machine ID %s, remove its %s tag to adopt it", d.VMID, id, machineIDTagPrefix+id)
+	}
+	if hasTag(orig, driverTag) {
+		return "", fmt.Errorf("vm %d is already managed by docker-machine, remove its %s tag to adopt it", d.VMID, driverTag)
+	}
+
+	tags := []string{}
+	if orig != "" {
+		tags = append(tags, orig)
+	}
+	tags = append(tags, driverTag, d.machineIDTag())
+	err = q.UpdateVmConfig(ctx, qemu.UpdateVmConfigRequest{
+		Node: d.Node,
+		Vmid: d.VMID,
+		Tags: proxmox.String(strings.Join(tags, ";")),
+	})
+	if err != nil {
+		return "", err
+	}
+	return orig, nil
+}
+
+// injectKey authorizes pub for SSHUser through the guest agent
+func (d *Driver) injectKey(pub string) error {
+	script := fmt.Sprintf(`set -e
+user=%s
+key=%s
+home=$(getent passwd "$user" | cut -d: -f6)
+[ -n "$home" ] || { echo "no user $user" >&2; exit 1; }
+mkdir -p "$home/.ssh"
+touch "$home/.ssh/authorized_keys"
+grep -qxF "$key" "$home/.ssh/authorized_keys" || echo "$key" >> "$home/.ssh/authorized_keys"
+chown -R "$user:" "$home/.ssh"
+chmod 700 "$home/.ssh"
+chmod 600 "$home/.ssh/authorized_keys"
+`, shellQuote(d.GetSSHUsername()), shellQuote(strings.TrimSpace(pub)))
+	_, err := d.agentExec(script, time.Minute)
+	return err
+}
+
+// shellQuote quotes s as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
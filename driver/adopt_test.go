@@ -0,0 +1,207 @@
+package driver
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAdoptTarget(t *testing.T) {
+	resources := []cluster.ResourcesResponse{
+		{Type: cluster.Type_QEMU, Vmid: proxmox.Int(100), Node: proxmox.String("pve1"), Name: proxmox.String("web")},
+		{Type: cluster.Type_QEMU, Vmid: proxmox.Int(101), Node: proxmox.String("pve2"), Name: proxmox.String("db")},
+		{Type: cluster.Type_QEMU, Vmid: proxmox.Int(102), Node: proxmox.String("pve2"), Name: proxmox.String("db")},
+		{Type: cluster.Type_LXC, Vmid: proxmox.Int(103), Node: proxmox.String("pve1"), Name: proxmox.String("ct")},
+	}
+	tests := map[string]struct {
+		adopt string
+		vmid  int
+		err   string
+	}{
+		"by VMID":   {adopt: "101", vmid: 101},
+		"by name":   {adopt: "web", vmid: 100},
+		"ambiguous": {adopt: "db", err: "2 VMs are named 'db'"},
+		"container": {adopt: "103", err: "no VM '103'"},
+		"missing":   {adopt: "nope", err: "no VM 'nope'"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			vm, err := adoptTarget(resources, tc.adopt)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.vmid, *vm.Vmid)
+		})
+	}
+}
+
+func TestTagVM(t *testing.T) {
+	tests := map[string]struct {
+		tags   string
+		tagged string
+		err    string
+	}{
+		"adds tags":     {tags: "prod", tagged: "prod;docker-machine;dm-id-abc"},
+		"untagged":      {tagged: "docker-machine;dm-id-abc"},
+		"managed":       {tags: "prod;docker-machine", err: "already managed by docker-machine"},
+		"other machine": {tags: "dm-id-def", err: "belongs to machine ID def"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tagged := ""
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/config":
+					fmt.Fprintf(w, `{"data":{"name":"web","tags":%q}}`, test.tags)
+				case r.Method == http.MethodPut && r.URL.Path == "/nodes/pve1/qemu/100/config":
+					body, _ := io.ReadAll(r.Body)
+					v, _ := url.ParseQuery(string(body))
+					tagged = v.Get("tags")
+					fmt.Fprint(w, `{"data":null}`)
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer s.Close()
+			d := &Driver{
+				Node:      "pve1",
+				VMID:      100,
+				MachineID: "abc",
+				client:    proxmox.NewClient(s.URL),
+			}
+			orig, err := d.tagVM(context.Background())
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				assert.Empty(t, tagged)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.tags, orig)
+			assert.Equal(t, test.tagged, tagged)
+		})
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	hostPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewPublicKey(hostPub)
+	require.NoError(t, err)
+	fileRead, err := json.Marshal(map[string]interface{}{
+		"data": map[string]string{"content": string(ssh.MarshalAuthorizedKey(hostKey))},
+	})
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		injectExit int
+		err        bool
+		tags       []string
+		status     string
+	}{
+		"adopts": {
+			tags:   []string{"prod;docker-machine;dm-id-abc"},
+			status: "running",
+		},
+		"inject fails": {
+			injectExit: 1,
+			err:        true,
+			tags:       []string{"prod;docker-machine;dm-id-abc", "prod"},
+			status:     "stopped",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := newKeyTestDriver(t)
+			store := d.StorePath
+			require.NoError(t, os.WriteFile(d.ResolveStorePath("config.json"), []byte(`{"DriverName":"proxmoxve","Driver":{}}`), 0600))
+			status := "stopped"
+			tags := []string{}
+			claimed := 0
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/cluster/resources":
+					fmt.Fprint(w, `{"data":[{"type":"qemu","vmid":100,"node":"pve1","name":"web"}]}`)
+				case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/config":
+					fmt.Fprint(w, `{"data":{"name":"web","tags":"prod"}}`)
+				case r.Method == http.MethodPut && r.URL.Path == "/nodes/pve1/qemu/100/config":
+					body, _ := io.ReadAll(r.Body)
+					v, _ := url.ParseQuery(string(body))
+					tags = append(tags, v.Get("tags"))
+					fmt.Fprint(w, `{"data":null}`)
+				case r.URL.Path == "/nodes/pve1/qemu/100/status/current":
+					fmt.Fprintf(w, `{"data":{"status":%q}}`, status)
+				case r.URL.Path == "/nodes/pve1/qemu/100/status/start":
+					status = "running"
+					fmt.Fprint(w, `{"data":"UPID:pve1:start"}`)
+				case r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:start/status":
+					fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+				case r.URL.Path == "/nodes/pve1/qemu/100/agent":
+					// dying while waiting for the network leaves the VM claimed
+					m, err := LoadMachine(store, "test")
+					assert.NoError(t, err)
+					if m != nil {
+						claimed = m.VMID
+					}
+					fmt.Fprint(w, `{"data":{"result":[{"name":"eth0","ip-addresses":[{"ip-address-type":"ipv4","ip-address":"10.0.0.5"}]}]}}`)
+				case r.URL.Path == "/nodes/pve1/qemu/100/agent/exec":
+					fmt.Fprint(w, `{"data":{"pid":42}}`)
+				case r.URL.Path == "/nodes/pve1/qemu/100/agent/exec-status":
+					fmt.Fprintf(w, `{"data":{"exited":1,"exitcode":%d}}`, test.injectExit)
+				case r.URL.Path == "/nodes/pve1/qemu/100/agent/file-read":
+					w.Write(fileRead)
+				case r.URL.Path == "/nodes/pve1/qemu/100/agent/shutdown":
+					status = "stopped"
+					fmt.Fprint(w, `{"data":null}`)
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer s.Close()
+			d.SSHUser = "core"
+			d.SSHKeyType = keyTypeEd25519
+			d.Adopt = "web"
+			d.AdoptInjectKey = true
+			d.MachineID = "abc"
+			d.client = proxmox.NewClient(s.URL)
+
+			err := d.adopt(context.Background())
+			if test.err {
+				assert.Error(t, err)
+				assert.Zero(t, d.VMID)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, 100, d.VMID)
+				assert.Equal(t, "web", d.VMName)
+				assert.Equal(t, "10.0.0.5", d.IPAddress)
+				assert.NotEmpty(t, d.SSHHostKey)
+			}
+			assert.Equal(t, test.tags, tags)
+			assert.Equal(t, test.status, status)
+			assert.Equal(t, 100, claimed)
+			m, err := LoadMachine(store, "test")
+			require.NoError(t, err)
+			assert.Equal(t, d.VMID, m.VMID)
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, `'core'`, shellQuote("core"))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+}
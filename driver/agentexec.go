@@ -0,0 +1,193 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu/agent"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	channelAuto  = "auto"
+	channelSSH   = "ssh"
+	channelAgent = "agent"
+)
+
+// RunCommand runs a shell command on the machine over SSH or, when SSH is
+// unavailable or disabled, through the QEMU guest agent
+func (d *Driver) RunCommand(cmd string) (string, error) {
+	switch d.CommandChannel {
+	case channelAgent:
+		return d.agentExec(cmd, 10*time.Minute)
+	case channelSSH:
+		return d.sshCommand(cmd)
+	}
+	if !d.sshReachable() {
+		d.debugf("ssh unreachable, running command through guest agent")
+		return d.agentExec(cmd, 10*time.Minute)
+	}
+	return d.sshCommand(cmd)
+}
+
+// PushFile writes content to path in the guest through the QEMU guest agent
+func (d *Driver) PushFile(path string, content []byte) error {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	a := agent.New(c)
+	return d.withVMNode(func() error {
+		return a.FileWrite(context.Background(), agent.FileWriteRequest{
+			Node:    d.Node,
+			Vmid:    d.VMID,
+			File:    path,
+			Content: string(content),
+		})
+	})
+}
+
+// PullFile reads path from the guest through the QEMU guest agent
+func (d *Driver) PullFile(path string) ([]byte, error) {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return nil, err
+	}
+
+	a := agent.New(c)
+	var resp agent.FileReadResponse
+	err = d.withVMNode(func() error {
+		resp, err = a.FileRead(context.Background(), agent.FileReadRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+			File: path,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated != nil && *resp.Truncated {
+		return nil, fmt.Errorf("%s is too large to read through the guest agent", path)
+	}
+	return []byte(resp.Content), nil
+}
+
+// waitForGuest waits for the guest to finish booting and, on machines
+// provisioned with ignition, for docker to answer. The checks go through
+// RunCommand, so they pass on the guest agent while SSH is not reachable.
+func (d *Driver) waitForGuest(ctx context.Context) error {
+	b := backoff{
+		Initial:    2 * time.Second,
+		Max:        15 * time.Second,
+		Jitter:     0.2,
+		MaxElapsed: d.networkTimeout(),
+		// neither SSH nor the agent answer until the guest is up
+		Retryable: func(error) bool { return true },
+	}
+	booted := ""
+	err := d.retry(ctx, b, func() error {
+		// is-system-running exits non-zero for anything but running
+		out, err := d.RunCommand("systemctl is-system-running --wait || true")
+		if err != nil {
+			return err
+		}
+		booted = strings.TrimSpace(out)
+		if booted == "initializing" || booted == "starting" {
+			return fmt.Errorf("guest is %s", booted)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("guest did not finish booting: %w", err)
+	}
+	switch booted {
+	case "running":
+	case "degraded":
+		log.Warnf("%s booted with failed units, see systemctl --failed", d.GetMachineName())
+	default:
+		return fmt.Errorf("guest is %s after booting", booted)
+	}
+
+	if !d.usesIgnition() {
+		return nil
+	}
+	return d.checkDocker(ctx)
+}
+
+func (d *Driver) sshReachable() bool {
+	if d.IPAddress == "" {
+		return false
+	}
+	port, err := d.BaseDriver.GetSSHPort()
+	if err != nil {
+		return false
+	}
+	conn, err := d.dialGuest(port)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// agentExec runs script with /bin/sh inside the guest and returns its stdout
+func (d *Driver) agentExec(script string, dur time.Duration) (string, error) {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return "", err
+	}
+
+	a := agent.New(c)
+	var exec agent.ExecResponse
+	err = d.withVMNode(func() error {
+		// the script is fed through stdin, sparing us from splitting it into arguments
+		exec, err = a.Exec(context.Background(), agent.ExecRequest{
+			Node:      d.Node,
+			Vmid:      d.VMID,
+			Command:   proxmox.String("/bin/sh"),
+			InputData: proxmox.String(script),
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	endTime := time.Now().Add(dur)
+	for !time.Now().After(endTime) {
+		resp, err := a.ExecStatus(context.Background(), agent.ExecStatusRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+			Pid:  exec.Pid,
+		})
+		if err != nil {
+			return "", err
+		}
+		if !resp.Exited {
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+
+		out := ""
+		if resp.OutData != nil {
+			out = *resp.OutData
+		}
+		if resp.Exitcode != nil && *resp.Exitcode != 0 {
+			stderr := ""
+			if resp.ErrData != nil {
+				stderr = *resp.ErrData
+			}
+			return out, fmt.Errorf("guest command exited with status %d: %s", *resp.Exitcode, stderr)
+		}
+		if resp.Signal != nil {
+			return out, fmt.Errorf("guest command killed by signal %d", *resp.Signal)
+		}
+		return out, nil
+	}
+	return "", fmt.Errorf("timed out waiting for guest command")
+}
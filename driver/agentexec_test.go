@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentExec(t *testing.T) {
+	tests := map[string]struct {
+		status string
+		out    string
+		err    bool
+	}{
+		"success": {
+			status: `{"exited":1,"exitcode":0,"out-data":"hello\n"}`,
+			out:    "hello\n",
+		},
+		"failure": {
+			status: `{"exited":1,"exitcode":2,"out-data":"","err-data":"boom"}`,
+			err:    true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			polls := 0
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodPost && r.URL.Path == "/nodes/pve1/qemu/100/agent/exec":
+					body, _ := io.ReadAll(r.Body)
+					form, _ := url.ParseQuery(string(body))
+					assert.Equal(t, "/bin/sh", form.Get("command"))
+					assert.Equal(t, "echo hello", form.Get("input-data"))
+					fmt.Fprint(w, `{"data":{"pid":42}}`)
+				case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/agent/exec-status":
+					assert.Equal(t, "42", r.URL.Query().Get("pid"))
+					polls++
+					if polls == 1 {
+						fmt.Fprint(w, `{"data":{"exited":0}}`)
+						return
+					}
+					fmt.Fprintf(w, `{"data":%s}`, test.status)
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer s.Close()
+			d := &Driver{
+				Node:   "pve1",
+				VMID:   100,
+				client: proxmox.NewClient(s.URL),
+			}
+			out, err := d.agentExec("echo hello", time.Minute)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.out, out)
+			assert.Equal(t, 2, polls)
+		})
+	}
+}
+
+func TestWaitForGuest(t *testing.T) {
+	scripts := map[string]string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/nodes/pve1/qemu/100/agent/exec":
+			body, _ := io.ReadAll(r.Body)
+			form, _ := url.ParseQuery(string(body))
+			pid := fmt.Sprint(len(scripts) + 1)
+			scripts[pid] = form.Get("input-data")
+			fmt.Fprintf(w, `{"data":{"pid":%s}}`, pid)
+		case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/agent/exec-status":
+			script := scripts[r.URL.Query().Get("pid")]
+			switch {
+			case strings.HasPrefix(script, "systemctl is-system-running"):
+				fmt.Fprint(w, `{"data":{"exited":1,"exitcode":0,"out-data":"running\n"}}`)
+			case strings.Contains(script, "docker version"):
+				fmt.Fprint(w, `{"data":{"exited":1,"exitcode":0,"out-data":"24.0.5\n"}}`)
+			default:
+				t.Errorf("unexpected script %q", script)
+			}
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		BaseDriver:     &drivers.BaseDriver{MachineName: "test"},
+		Node:           "pve1",
+		VMID:           100,
+		CommandChannel: channelAgent,
+		client:         proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.waitForGuest(context.Background()))
+	assert.Len(t, scripts, 2)
+}
@@ -0,0 +1,245 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster/backup"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/vzdump"
+	"github.com/labstack/gommon/log"
+)
+
+// Backup runs vzdump for the VM onto storage, which may be a Proxmox Backup
+// Server storage. An empty mode uses snapshot mode.
+func (d *Driver) Backup(storage, mode string) error {
+	if d.VMID < 1 {
+		return errors.New("invalid VMID")
+	}
+
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	if mode == "" {
+		mode = string(vzdump.Mode_SNAPSHOT)
+	}
+	req := vzdump.CreateRequest{
+		Vmid: proxmox.String(strconv.Itoa(d.VMID)),
+		Mode: vzdump.PtrMode(vzdump.Mode(mode)),
+	}
+	if storage != "" {
+		req.Storage = proxmox.String(storage)
+	}
+
+	d.debugf("backing up vm %d to '%s'", d.VMID, storage)
+	err = d.locateVM()
+	if err != nil {
+		return err
+	}
+	req.Node = proxmox.String(d.Node)
+	taskID, err := vzdump.New(c).Create(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	return d.waitForTaskToComplete(context.Background(), taskID, 4*time.Hour)
+}
+
+// Restore restores a backup volume into a new VM on the node currently
+// hosting the machine's VM and returns the new VMID
+func (d *Driver) Restore(volume, storage string) (int, error) {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return 0, err
+	}
+
+	if d.VMID > 0 {
+		err = d.locateVM()
+		if err != nil {
+			// restoring is how a lost VM is recovered
+			log.Warnf("Restoring onto %s: %v", d.Node, err)
+		}
+	}
+
+	req := qemu.CreateRequest{
+		Node:    d.Node,
+		Archive: proxmox.String(volume),
+		Unique:  proxmox.PVEBool(true),
+	}
+	if storage != "" {
+		req.Storage = proxmox.String(storage)
+	}
+	if d.Pool != "" {
+		req.Pool = proxmox.String(d.Pool)
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	q := qemu.New(c)
+	return d.createWithVMID(ctx, c, 4*time.Hour, func(id int) (string, error) {
+		d.debugf("restoring %s into vm %d", volume, id)
+		req.Vmid = id
+		return q.Create(ctx, req)
+	})
+}
+
+// SwitchVM points the machine at the VM id on the machine's node, such as one
+// restored from a backup, starting it and reading its IP address. The previous
+// VM is then stopped, or removed when removeOld is set.
+func (d *Driver) SwitchVM(id int, removeOld bool) error {
+	ctx, stop := signalContext()
+	defer stop()
+
+	old := &Driver{
+		BaseDriver:        d.BaseDriver,
+		client:            d.client,
+		Host:              d.Host,
+		User:              d.User,
+		Password:          d.Password,
+		Realm:             d.Realm,
+		Node:              d.Node,
+		VMID:              d.VMID,
+		VMName:            d.VMName,
+		MachineID:         d.MachineID,
+		HAEnabled:         d.HAEnabled,
+		Protection:        d.Protection,
+		KeepDataDisks:     d.KeepDataDisks,
+		KeepDataDisksVMID: d.KeepDataDisksVMID,
+		driverDebug:       d.driverDebug,
+	}
+
+	d.VMID = id
+	err := d.start(ctx)
+	if err != nil {
+		return err
+	}
+	err = d.waitForNetwork(ctx)
+	if err != nil {
+		return err
+	}
+	err = d.writeKnownHosts()
+	if err != nil {
+		return err
+	}
+	if old.VMID < 1 {
+		return nil
+	}
+
+	if removeOld {
+		err = old.remove(ctx)
+	} else {
+		// HA would restart the old VM
+		if old.HAEnabled {
+			err = old.unregisterHA(ctx)
+			if err != nil {
+				return fmt.Errorf("could not remove HA resource of vm %d: %w", old.VMID, err)
+			}
+		}
+		err = old.kill(ctx)
+	}
+	if err != nil && !isVMMissing(err) {
+		return fmt.Errorf("switched to vm %d, but vm %d is still around: %w", id, old.VMID, err)
+	}
+	if d.HAEnabled {
+		return d.registerHA(ctx)
+	}
+	return nil
+}
+
+// errBackupJobLost is returned when the VM went missing from a backup job
+// right after adding it, as another update of the job overwrote its list
+var errBackupJobLost = errors.New("vm was dropped from the backup job by a concurrent update")
+
+// addToBackupJob adds the VM to an existing backup job that selects guests
+// by VMID. Proxmox VE replaces the job's VMID list as a whole, so the job is
+// read back and the VM added again should a concurrent update have dropped it.
+func (d *Driver) addToBackupJob(ctx context.Context, job string) error {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	b := backup.New(c)
+	bo := backoff{
+		Initial:    500 * time.Millisecond,
+		Max:        5 * time.Second,
+		Jitter:     0.5, // spread out creates racing for the same job
+		MaxElapsed: 2 * time.Minute,
+		Retryable: func(err error) bool {
+			return errors.Is(err, errBackupJobLost) || isRetryable(err)
+		},
+	}
+	return d.retry(ctx, bo, func() error {
+		vmids, err := d.backupJobVMIDs(ctx, b, job)
+		if err != nil || vmids == nil {
+			return err
+		}
+		vmids = append(vmids, strconv.Itoa(d.VMID))
+
+		d.debugf("adding vm %d to backup job %s", d.VMID, job)
+		err = b.Update(ctx, backup.UpdateRequest{
+			Id:   job,
+			Vmid: proxmox.String(strings.Join(vmids, ",")),
+		})
+		if err != nil {
+			return err
+		}
+		vmids, err = d.backupJobVMIDs(ctx, b, job)
+		if err != nil {
+			return err
+		}
+		if vmids != nil {
+			return errBackupJobLost
+		}
+		return nil
+	})
+}
+
+// backupJobVMIDs returns the VMIDs job selects, or nil when the job already
+// includes the VM
+func (d *Driver) backupJobVMIDs(ctx context.Context, b *backup.Client, job string) ([]string, error) {
+	cfg, err := b.Find(ctx, backup.FindRequest{Id: job})
+	if err != nil {
+		return nil, err
+	}
+	if pveTrue(cfg["all"]) {
+		d.debugf("backup job %s already includes all guests", job)
+		return nil, nil
+	}
+	if pool, ok := cfg["pool"].(string); ok && pool != "" {
+		if pool == d.Pool {
+			d.debugf("backup job %s already includes pool %s", job, pool)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("backup job %s selects pool %s, not individual VMs", job, pool)
+	}
+
+	vmids := []string{}
+	if s, ok := cfg["vmid"].(string); ok && s != "" {
+		vmids = strings.Split(s, ",")
+	}
+	if slices.Contains(vmids, strconv.Itoa(d.VMID)) {
+		return nil, nil
+	}
+	return vmids, nil
+}
+
+// pveTrue reports whether a loosely typed Proxmox VE boolean is set
+func pveTrue(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case float64:
+		return b != 0
+	case string:
+		return b == "1" || b == "true"
+	}
+	return false
+}
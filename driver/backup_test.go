@@ -0,0 +1,166 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddToBackupJob(t *testing.T) {
+	tests := map[string]struct {
+		job    string
+		racing string
+		update string
+		puts   int
+		err    bool
+	}{
+		"vmid list":      {job: `{"id":"backup-1","vmid":"101,102"}`, update: "101,102,100", puts: 1},
+		"empty":          {job: `{"id":"backup-1"}`, update: "100", puts: 1},
+		"already listed": {job: `{"id":"backup-1","vmid":"100,101"}`},
+		"all guests":     {job: `{"id":"backup-1","all":1}`},
+		"same pool":      {job: `{"id":"backup-1","pool":"docker"}`},
+		"other pool":     {job: `{"id":"backup-1","pool":"other"}`, err: true},
+		"concurrent update": {
+			job:    `{"id":"backup-1","vmid":"101,102"}`,
+			racing: "101,102,103",
+			update: "101,102,103,100",
+			puts:   2,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			job := tc.job
+			update := ""
+			puts := 0
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/cluster/backup/backup-1", r.URL.Path)
+				if r.Method == http.MethodPut {
+					body, _ := io.ReadAll(r.Body)
+					form, err := url.ParseQuery(string(body))
+					assert.NoError(t, err)
+					update = form.Get("vmid")
+					puts++
+					if puts == 1 && tc.racing != "" {
+						// another create's update lands right after ours
+						update = tc.racing
+					}
+					job = fmt.Sprintf(`{"id":"backup-1","vmid":%q}`, update)
+					fmt.Fprint(w, `{"data":null}`)
+					return
+				}
+				fmt.Fprintf(w, `{"data":%s}`, job)
+			}))
+			defer s.Close()
+			d := &Driver{
+				VMID:   100,
+				Pool:   "docker",
+				client: proxmox.NewClient(s.URL),
+			}
+			err := d.addToBackupJob(context.Background(), "backup-1")
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.update, update)
+			assert.Equal(t, tc.puts, puts)
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tried := []string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/cluster/resources":
+			fmt.Fprint(w, `{"data":[{"id":"qemu/100","type":"qemu","vmid":100,"node":"pve2"}]}`)
+		case r.URL.Path == "/cluster/nextid":
+			fmt.Fprint(w, `{"data":"101"}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/nodes/pve2/qemu":
+			body, _ := io.ReadAll(r.Body)
+			form, err := url.ParseQuery(string(body))
+			assert.NoError(t, err)
+			assert.Equal(t, "pbs:backup/vm/100/2024-01-01T00:00:00Z", form.Get("archive"))
+			vmid := form.Get("vmid")
+			tried = append(tried, vmid)
+			if vmid == "101" {
+				writePVEError(t, w, 500, "unable to create VM 101 - VM 101 already exists on node 'pve1'")
+				return
+			}
+			fmt.Fprintf(w, `{"data":"UPID:pve2:restore%s"}`, vmid)
+		case r.URL.Path == "/nodes/pve2/tasks/UPID:pve2:restore102/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		BaseDriver: &drivers.BaseDriver{MachineName: "test"},
+		Node:       "pve1",
+		VMID:       100,
+		client:     proxmox.NewClient(s.URL),
+	}
+	id, err := d.Restore("pbs:backup/vm/100/2024-01-01T00:00:00Z", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 102, id)
+	assert.Equal(t, "pve2", d.Node)
+	assert.Equal(t, []string{"101", "102"}, tried)
+	assert.Equal(t, 100, d.VMID)
+}
+
+func TestSwitchVMRemoveOld(t *testing.T) {
+	var detached, destroy string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/nodes/pve1/qemu/101/status/current":
+			fmt.Fprint(w, `{"data":{"status":"stopped"}}`)
+		case r.URL.Path == "/nodes/pve1/qemu/101/status/start":
+			fmt.Fprint(w, `{"data":"UPID:pve1:start"}`)
+		case r.URL.Path == "/nodes/pve1/qemu/101/agent":
+			fmt.Fprint(w, `{"data":{"result":[{"name":"eth0","ip-addresses":[{"ip-address-type":"ipv4","ip-address":"10.0.0.6"}]}]}}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/config":
+			fmt.Fprint(w, `{"data":{"name":"test","tags":"docker-machine;dm-id-abc"}}`)
+		case r.URL.Path == "/nodes/pve1/qemu/100/pending":
+			fmt.Fprint(w, `{"data":[{"key":"scsi0","value":"local-lvm:vm-100-disk-0"},{"key":"scsi1","value":"nfs:900/vm-900-disk-0.qcow2"}]}`)
+		case r.URL.Path == "/nodes/pve1/qemu/100/status/stop":
+			fmt.Fprint(w, `{"data":"UPID:pve1:stop"}`)
+		case r.Method == http.MethodPut && r.URL.Path == "/nodes/pve1/qemu/100/config":
+			body, _ := io.ReadAll(r.Body)
+			v, _ := url.ParseQuery(string(body))
+			detached = v.Get("delete")
+			fmt.Fprint(w, `{"data":null}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/nodes/pve1/qemu/100":
+			destroy = r.URL.Query().Get("destroy-unreferenced-disks")
+			fmt.Fprint(w, `{"data":"UPID:pve1:delete"}`)
+		case r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:start/status",
+			r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:stop/status",
+			r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:delete/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		BaseDriver:    &drivers.BaseDriver{MachineName: "test"},
+		Node:          "pve1",
+		VMID:          100,
+		MachineID:     "abc",
+		KeepDataDisks: true,
+		client:        proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.SwitchVM(101, true))
+	assert.Equal(t, 101, d.VMID)
+	assert.Equal(t, "10.0.0.6", d.IPAddress)
+	assert.Equal(t, "scsi1", detached)
+	assert.Equal(t, "0", destroy)
+}
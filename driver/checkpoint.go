@@ -0,0 +1,141 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docker/machine/libmachine/state"
+	"github.com/labstack/gommon/log"
+)
+
+const checkpointFile = "create-checkpoint.json"
+
+// Create steps recorded in the checkpoint once completed
+const (
+	stepCreated   = "created"
+	stepResized   = "resized"
+	stepStarted   = "started"
+	stepHA        = "ha"
+	stepBackupJob = "backup-job"
+)
+
+// createCheckpoint records the progress of Create in the machine store.
+// docker-machine saves the machine before calling Create, but with no VMID,
+// so the VMID is recorded here before the VM is requested. Should the create
+// die, remove and reconcile find the VM by it, and a rerun of Create resumes
+// after the last completed step.
+type createCheckpoint struct {
+	VMID       int
+	Node       string
+	MachineID  string
+	SSHKeyPath string
+	SSHHostKey string
+	Steps      []string
+
+	path string
+}
+
+func (d *Driver) newCheckpoint() *createCheckpoint {
+	return &createCheckpoint{path: d.ResolveStorePath(checkpointFile)}
+}
+
+// loadCheckpoint reads the checkpoint of an unfinished Create, which has no
+// VMID if there is none
+func (d *Driver) loadCheckpoint() (*createCheckpoint, error) {
+	cp := d.newCheckpoint()
+	buf, err := os.ReadFile(cp.path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, cp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid create checkpoint %s: %w", cp.path, err)
+	}
+	return cp, nil
+}
+
+func (cp *createCheckpoint) has(step string) bool {
+	for _, s := range cp.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (cp *createCheckpoint) done(step string) error {
+	cp.Steps = append(cp.Steps, step)
+	return cp.save()
+}
+
+func (cp *createCheckpoint) save() error {
+	if cp.path == "" {
+		return nil
+	}
+	buf, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(cp.path, buf, 0600)
+	if err != nil {
+		return fmt.Errorf("could not save create checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (cp *createCheckpoint) clear() {
+	if cp.path != "" {
+		os.Remove(cp.path)
+	}
+}
+
+// resumeCheckpoint loads the checkpoint of an earlier Create. When its VM
+// still exists and belongs to this machine the driver is pointed at it,
+// otherwise Create starts over.
+func (d *Driver) resumeCheckpoint(ctx context.Context) (*createCheckpoint, error) {
+	cp, err := d.loadCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if cp.VMID < 1 {
+		if d.VMID > 0 {
+			return nil, fmt.Errorf("vm %d is already created, there is no create to resume", d.VMID)
+		}
+		return d.newCheckpoint(), nil
+	}
+
+	d.VMID = cp.VMID
+	d.Node = cp.Node
+	d.MachineID = cp.MachineID
+	d.SSHKeyPath = cp.SSHKeyPath
+	d.SSHHostKey = cp.SSHHostKey
+	err = d.verifyVM(ctx)
+	if isVMMissing(err) {
+		d.debugf("vm %d from the create checkpoint is gone, starting over", cp.VMID)
+		d.VMID = 0
+		return d.newCheckpoint(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot resume create of vm %d, remove %s to start over: %w", cp.VMID, cp.path, err)
+	}
+
+	log.Infof("Resuming create of VM %d on %s after steps %v", d.VMID, d.Node, cp.Steps)
+	if !cp.has(stepCreated) {
+		// the create request went through, let its task finish
+		err = d.waitForState(state.Stopped, 10*time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		err = cp.done(stepCreated)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cp, nil
+}
@@ -0,0 +1,197 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveCheckpointed(t *testing.T) {
+	tests := map[string]struct {
+		config  func(w http.ResponseWriter)
+		deleted bool
+	}{
+		"removes": {
+			config: func(w http.ResponseWriter) {
+				fmt.Fprint(w, `{"data":{"name":"test","tags":"docker-machine;dm-id-abc"}}`)
+			},
+			deleted: true,
+		},
+		"someone else's vm": {
+			config: func(w http.ResponseWriter) {
+				fmt.Fprint(w, `{"data":{"name":"other","tags":"docker-machine;dm-id-def"}}`)
+			},
+		},
+		"vm gone": {
+			config: func(w http.ResponseWriter) {
+				writePVEError(t, w, 500, "Configuration file 'nodes/pve1/qemu-server/100.conf' does not exist")
+			},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			deleted := false
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/config":
+					test.config(w)
+				case r.URL.Path == "/nodes/pve1/qemu/100/status/stop":
+					fmt.Fprint(w, `{"data":"UPID:pve1:stop"}`)
+				case r.Method == http.MethodDelete && r.URL.Path == "/nodes/pve1/qemu/100":
+					deleted = true
+					fmt.Fprint(w, `{"data":"UPID:pve1:delete"}`)
+				case r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:stop/status",
+					r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:delete/status":
+					fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+				case r.URL.Path == "/cluster/resources":
+					fmt.Fprint(w, `{"data":[]}`)
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer s.Close()
+			d := newKeyTestDriver(t)
+			d.client = proxmox.NewClient(s.URL)
+			saved := &createCheckpoint{
+				VMID:      100,
+				Node:      "pve1",
+				MachineID: "abc",
+				path:      d.ResolveStorePath(checkpointFile),
+			}
+			require.NoError(t, saved.save())
+
+			require.NoError(t, d.remove(context.Background()))
+			assert.Equal(t, test.deleted, deleted)
+			_, err := os.Stat(d.ResolveStorePath(checkpointFile))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestResumeCheckpoint(t *testing.T) {
+	tests := map[string]struct {
+		config  string
+		err     bool
+		vmid    int
+		started bool
+	}{
+		"resumes": {
+			config:  `{"name":"test","tags":"docker-machine;dm-id-abc"}`,
+			vmid:    100,
+			started: true,
+		},
+		"renamed": {
+			config: `{"name":"other","tags":"docker-machine;dm-id-abc"}`,
+			err:    true,
+		},
+		"someone else's vm": {
+			config: `{"name":"test","tags":"docker-machine;dm-id-def"}`,
+			err:    true,
+		},
+		"vm gone": {},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/nodes/pve1/qemu/100/config":
+					if test.config == "" {
+						writePVEError(t, w, 500, "Configuration file 'nodes/pve1/qemu-server/100.conf' does not exist")
+						return
+					}
+					fmt.Fprintf(w, `{"data":%s}`, test.config)
+				case "/cluster/resources":
+					fmt.Fprint(w, `{"data":[]}`)
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer s.Close()
+			d := newKeyTestDriver(t)
+			d.client = proxmox.NewClient(s.URL)
+			saved := &createCheckpoint{
+				VMID:      100,
+				Node:      "pve1",
+				MachineID: "abc",
+				Steps:     []string{stepCreated, stepStarted},
+				path:      d.ResolveStorePath(checkpointFile),
+			}
+			require.NoError(t, saved.save())
+
+			cp, err := d.resumeCheckpoint(context.Background())
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.vmid, d.VMID)
+			assert.Equal(t, test.started, cp.has(stepStarted))
+		})
+	}
+}
+
+func TestCreateResumes(t *testing.T) {
+	scripts := map[string]string{}
+	ignitionCleared := false
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/config":
+			fmt.Fprint(w, `{"data":{"name":"test","tags":"docker-machine;dm-id-abc"}}`)
+		case r.Method == http.MethodPut && r.URL.Path == "/nodes/pve1/qemu/100/config":
+			body, _ := io.ReadAll(r.Body)
+			v, _ := url.ParseQuery(string(body))
+			ignitionCleared = v.Get("delete") == "args"
+			fmt.Fprint(w, `{"data":null}`)
+		case r.URL.Path == "/nodes/pve1/qemu/100/agent":
+			fmt.Fprint(w, `{"data":{"result":[{"name":"eth0","ip-addresses":[{"ip-address-type":"ipv4","ip-address":"10.0.0.5"}]}]}}`)
+		case r.URL.Path == "/nodes/pve1/qemu/100/agent/exec":
+			body, _ := io.ReadAll(r.Body)
+			v, _ := url.ParseQuery(string(body))
+			pid := fmt.Sprint(len(scripts) + 1)
+			scripts[pid] = v.Get("input-data")
+			fmt.Fprintf(w, `{"data":{"pid":%s}}`, pid)
+		case r.URL.Path == "/nodes/pve1/qemu/100/agent/exec-status":
+			script := scripts[r.URL.Query().Get("pid")]
+			out := "running\n"
+			if strings.Contains(script, "docker version") {
+				out = "24.0.5\n"
+			}
+			fmt.Fprintf(w, `{"data":{"exited":1,"exitcode":0,"out-data":%q}}`, out)
+		default:
+			// in particular no new VM and no second start
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := newKeyTestDriver(t)
+	d.CommandChannel = channelAgent
+	d.client = proxmox.NewClient(s.URL)
+	require.NoError(t, os.WriteFile(d.ResolveStorePath("config.json"), []byte(`{"DriverName":"proxmoxve","Driver":{}}`), 0600))
+	saved := &createCheckpoint{
+		VMID:      100,
+		Node:      "pve1",
+		MachineID: "abc",
+		Steps:     []string{stepCreated, stepStarted},
+		path:      d.ResolveStorePath(checkpointFile),
+	}
+	require.NoError(t, saved.save())
+
+	require.NoError(t, d.Create())
+	assert.True(t, ignitionCleared)
+	assert.Equal(t, "10.0.0.5", d.IPAddress)
+	_, err := os.Stat(d.ResolveStorePath(checkpointFile))
+	assert.True(t, os.IsNotExist(err))
+	loaded, err := LoadMachine(d.StorePath, "test")
+	require.NoError(t, err)
+	assert.Equal(t, 100, loaded.VMID)
+}
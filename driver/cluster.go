@@ -4,12 +4,15 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"regexp"
 	"slices"
 	"strings"
 	"time"
 
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
 	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster/ha/groups"
 	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/lxc"
 	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
 )
 
@@ -20,7 +23,9 @@ const (
 	GB
 )
 
-func (d *Driver) findAvailableNode() (string, error) {
+// findAvailableNode chooses the node to place the VM on, never choosing one
+// of the excluded nodes
+func (d *Driver) findAvailableNode(ctx context.Context, exclude ...string) (string, error) {
 	d.debugf("finding available node")
 	client, err := d.EnsureClient()
 	if err != nil {
@@ -31,69 +36,63 @@ func (d *Driver) findAvailableNode() (string, error) {
 		d.debugf("found node %s using that", d.Node)
 		return d.Node, nil
 	}
-	if d.Group == "" {
-		return "", fmt.Errorf("Cannot automatically choose node without HA group")
-	}
-
-	d.debugf("loading group %s", d.Group)
-	g := groups.New(client)
-	group, err := g.Find(context.Background(), groups.FindRequest{Group: d.Group})
+	nodesList, err := d.placementNodes(ctx, client)
 	if err != nil {
 		return "", err
 	}
-	nodesStr, ok := group["nodes"].(string)
-	if !ok {
-		return "", fmt.Errorf("bad format groups.nodes response %+v", group["nodes"])
+	var selector *regexp.Regexp
+	if d.NodeSelector != "" {
+		selector, err = regexp.Compile(d.NodeSelector)
+		if err != nil {
+			return "", fmt.Errorf("invalid node selector '%s': %w", d.NodeSelector, err)
+		}
 	}
-	d.debugf("looking for availability in %s", nodesStr)
-	nodesList := strings.Split(strings.TrimSpace(nodesStr), ",")
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(nodesList), func(i, j int) { nodesList[i], nodesList[j] = nodesList[j], nodesList[i] })
 
 	n := nodes.New(client)
-	nodeResp, err := n.Index(context.Background())
+	nodeResp, err := n.Index(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	q := qemu.New(client)
-
-	// Look for lowest utilization based on memory
+	// Look for the fewest anti-affinity peers, then lowest utilization based on memory
 	bestNode := ""
 	maxAvailMem := 0
+	minPeers := 0
 	for _, node := range nodeResp {
-		if !slices.Contains(nodesList, node.Node) {
+		if nodesList != nil && !slices.Contains(nodesList, node.Node) {
+			continue
+		}
+		if selector != nil && !selector.MatchString(node.Node) {
 			continue
 		}
-		if node.Status != "online" {
+		if node.Status != "online" || slices.Contains(exclude, node.Node) {
 			continue
 		}
 
-		d.debugf("loading vms for %s", node.Node)
-		vms, err := q.Index(context.Background(), qemu.IndexRequest{
-			Node: node.Node,
-		})
+		usage, err := d.nodeUsage(ctx, client, node)
 		if err != nil {
 			return "", err
 		}
 
-		usedCPU := 0
-		usedMem := 0
-		for _, vm := range vms {
-			if vm.Status != "running" {
-				continue
-			}
-			usedCPU += int(*vm.Cpus)
-			usedMem += *vm.Maxmem
-		}
-		d.debugf("Checking node with %dCPU & %dMemory", *node.Maxcpu, *node.Maxmem/GB)
-		d.debugf("Using %dCPU & %dMemory", usedCPU, usedMem/GB)
+		capCPU := int(float64(*node.Maxcpu) * overcommit(d.CPUOvercommit))
+		capMem := int(float64(*node.Maxmem)*overcommit(d.MemOvercommit)) - d.HostReservedMem*MB
+		d.debugf("Checking node with %dCPU & %dMemory", capCPU, capMem/GB)
+		d.debugf("Using %dCPU & %dMemory with %d anti-affinity peers", usage.cpu, usage.mem/GB, usage.peers)
 		d.debugf("Requesting %dCPU & %dMemory", d.CPUCores, d.Memory)
-		if *node.Maxmem-usedMem > maxAvailMem &&
-			usedMem+(d.Memory/1024)*GB < *node.Maxmem &&
-			d.CPUCores+usedCPU < int(*node.Maxcpu) {
+		if usage.mem+d.Memory*MB >= capMem || d.CPUCores+usage.cpu >= capCPU {
+			continue
+		}
+		if d.AntiAffinityStrict && usage.peers > 0 {
+			d.debugf("skipping %s, already hosting %d anti-affinity peers", node.Node, usage.peers)
+			continue
+		}
+		availMem := capMem - usage.mem
+		if bestNode == "" ||
+			usage.peers < minPeers ||
+			(usage.peers == minPeers && availMem > maxAvailMem) {
 			bestNode = node.Node
-			maxAvailMem = (*node.Maxmem) - usedMem
+			maxAvailMem = availMem
+			minPeers = usage.peers
 		}
 	}
 	if bestNode == "" {
@@ -101,3 +100,113 @@ func (d *Driver) findAvailableNode() (string, error) {
 	}
 	return bestNode, nil
 }
+
+// placementNodes returns the nodes eligible for placement, either the members
+// of the HA group or the configured node list. A nil list means any online
+// node may be used.
+func (d *Driver) placementNodes(ctx context.Context, client *proxmox.Client) ([]string, error) {
+	nodesStr := ""
+	if d.Group != "" {
+		d.debugf("loading group %s", d.Group)
+		g := groups.New(client)
+		group, err := g.Find(ctx, groups.FindRequest{Group: d.Group})
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		nodesStr, ok = group["nodes"].(string)
+		if !ok {
+			return nil, fmt.Errorf("bad format groups.nodes response %+v", group["nodes"])
+		}
+	} else if d.NodeList != "" {
+		nodesStr = d.NodeList
+	} else if d.AnyNode || d.NodeSelector != "" {
+		d.debugf("looking for availability in all online nodes")
+		return nil, nil
+	} else {
+		return nil, fmt.Errorf("Cannot automatically choose node without HA group, node list, node selector or any node")
+	}
+
+	d.debugf("looking for availability in %s", nodesStr)
+	nodesList := []string{}
+	for _, n := range strings.Split(strings.TrimSpace(nodesStr), ",") {
+		// HA groups list members as node[:priority]
+		n, _, _ = strings.Cut(strings.TrimSpace(n), ":")
+		if n != "" {
+			nodesList = append(nodesList, n)
+		}
+	}
+	rand.Seed(time.Now().UnixNano())
+	rand.Shuffle(len(nodesList), func(i, j int) { nodesList[i], nodesList[j] = nodesList[j], nodesList[i] })
+	return nodesList, nil
+}
+
+type nodeUsage struct {
+	cpu   int // cores allocated to running guests
+	mem   int // memory in bytes allocated to running guests, or in use on the node
+	peers int // VMs tagged with the anti-affinity key
+}
+
+// nodeUsage returns the CPUs and memory already committed on a node by running
+// QEMU VMs and LXC containers. When PlacementUseNodeMem is set the memory
+// figure is the node's reported usage instead, which accounts for host
+// processes, ballooning and ZFS ARC.
+func (d *Driver) nodeUsage(ctx context.Context, client *proxmox.Client, node nodes.IndexResponse) (nodeUsage, error) {
+	usage := nodeUsage{}
+	d.debugf("loading vms for %s", node.Node)
+	vms, err := qemu.New(client).Index(ctx, qemu.IndexRequest{
+		Node: node.Node,
+	})
+	if err != nil {
+		return usage, err
+	}
+
+	d.debugf("loading containers for %s", node.Node)
+	cts, err := lxc.New(client).Index(ctx, lxc.IndexRequest{
+		Node: node.Node,
+	})
+	if err != nil {
+		return usage, err
+	}
+
+	affinityTag := sanitizeTag(d.AntiAffinityKey)
+	for _, vm := range vms {
+		if affinityTag != "" && vm.Tags != nil && hasTag(*vm.Tags, affinityTag) {
+			usage.peers++
+		}
+		if vm.Status != qemu.Status_RUNNING {
+			continue
+		}
+		if vm.Cpus != nil {
+			usage.cpu += int(*vm.Cpus)
+		}
+		if vm.Maxmem != nil {
+			usage.mem += *vm.Maxmem
+		}
+	}
+	for _, ct := range cts {
+		if ct.Status != lxc.Status_RUNNING {
+			continue
+		}
+		if ct.Cpus != nil {
+			usage.cpu += int(*ct.Cpus)
+		}
+		if ct.Maxmem != nil {
+			usage.mem += *ct.Maxmem
+		}
+	}
+
+	if d.PlacementUseNodeMem && node.Mem != nil {
+		usage.mem = *node.Mem
+	}
+	return usage, nil
+}
+
+// overcommit returns the ratio to apply, machines created before overcommit
+// was configurable have no ratio stored and get none
+func overcommit(r float64) float64 {
+	if r <= 0 {
+		return 1
+	}
+	return r
+}
@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -26,6 +27,11 @@ func TestFindAvailableNode(t *testing.T) {
 			return
 		}
 
+		if strings.Contains(r.URL.Path, "/lxc") {
+			fmt.Fprintf(w, `{"data":[{"cpus": 2,"maxmem":%d,"status":"running"},{"cpus": 8,"maxmem":%d,"status":"stopped"}]}`, 4*gig, 64*gig)
+			return
+		}
+
 		if strings.Contains(r.URL.Path, "/nodes") {
 			fmt.Fprintf(w, `{"data":[{"node":"node2","maxmem":%d,"maxcpu":128,"status":"offline"},{"node":"node1","maxmem":%d,"maxcpu":%d,"status":"online"}]}`, 256*gig, 128*gig, 32)
 			return
@@ -40,7 +46,167 @@ func TestFindAvailableNode(t *testing.T) {
 		Group:       "some-group",
 		client:      proxmox.NewClient(s.URL),
 	}
-	resp, err := d.findAvailableNode()
+	resp, err := d.findAvailableNode(context.Background())
 	assert.Equal(t, "node1", resp)
 	assert.NoError(t, err)
 }
+
+func TestFindAvailableNodeCapacity(t *testing.T) {
+	gig := 1024 * 1024 * 1024
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/cluster/ha/groups") {
+			fmt.Fprintf(w, `{"data":{"nodes":"node1"}}`)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/qemu") {
+			fmt.Fprintf(w, `{"data":[{"cpus": 6,"maxmem":%d,"status":"running"}]}`, 12*gig)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/lxc") {
+			fmt.Fprintf(w, `{"data":[{"cpus": 1,"maxmem":%d,"status":"running"}]}`, 2*gig)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/nodes") {
+			fmt.Fprintf(w, `{"data":[{"node":"node1","maxmem":%d,"mem":%d,"maxcpu":16,"status":"online"}]}`, 16*gig, 4*gig)
+			return
+		}
+	}))
+	defer s.Close()
+
+	tests := map[string]struct {
+		driver *Driver
+		node   string
+	}{
+		"guests exhaust memory": {
+			driver: &Driver{Memory: 4 * 1024, CPUCores: 1},
+		},
+		"memory overcommit": {
+			driver: &Driver{Memory: 4 * 1024, CPUCores: 1, MemOvercommit: 1.5},
+			node:   "node1",
+		},
+		"guests exhaust cpu": {
+			driver: &Driver{Memory: 1024, CPUCores: 9, MemOvercommit: 1.5},
+		},
+		"cpu overcommit": {
+			driver: &Driver{Memory: 1024, CPUCores: 9, MemOvercommit: 1.5, CPUOvercommit: 2},
+			node:   "node1",
+		},
+		"node memory usage": {
+			driver: &Driver{Memory: 4 * 1024, CPUCores: 1, PlacementUseNodeMem: true},
+			node:   "node1",
+		},
+		"host reserved memory": {
+			driver: &Driver{Memory: 4 * 1024, CPUCores: 1, PlacementUseNodeMem: true, HostReservedMem: 8 * 1024},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := tc.driver
+			d.Group = "some-group"
+			d.client = proxmox.NewClient(s.URL)
+			resp, err := d.findAvailableNode(context.Background())
+			assert.Equal(t, tc.node, resp)
+			if tc.node == "" {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestFindAvailableNodeSources(t *testing.T) {
+	gig := 1024 * 1024 * 1024
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/cluster/ha/groups") {
+			fmt.Fprintf(w, `{"data":{"nodes":"pve1:2,pve2:1"}}`)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/qemu") || strings.Contains(r.URL.Path, "/lxc") {
+			fmt.Fprint(w, `{"data":[]}`)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/nodes") {
+			fmt.Fprintf(w, `{"data":[{"node":"pve1","maxmem":%d,"maxcpu":8,"status":"online"},{"node":"pve2","maxmem":%d,"maxcpu":8,"status":"online"},{"node":"backup1","maxmem":%d,"maxcpu":8,"status":"online"}]}`, 16*gig, 32*gig, 64*gig)
+			return
+		}
+	}))
+	defer s.Close()
+
+	tests := map[string]struct {
+		driver *Driver
+		node   string
+	}{
+		"no source":          {driver: &Driver{}},
+		"ha group":           {driver: &Driver{Group: "some-group"}, node: "pve2"},
+		"node list":          {driver: &Driver{NodeList: "pve1, backup1"}, node: "backup1"},
+		"node selector":      {driver: &Driver{NodeSelector: "^pve"}, node: "pve2"},
+		"any node":           {driver: &Driver{AnyNode: true}, node: "backup1"},
+		"list with selector": {driver: &Driver{NodeList: "pve1,backup1", NodeSelector: "^pve"}, node: "pve1"},
+		"invalid selector":   {driver: &Driver{NodeSelector: "("}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := tc.driver
+			d.Memory = 1024
+			d.CPUCores = 1
+			d.client = proxmox.NewClient(s.URL)
+			resp, err := d.findAvailableNode(context.Background())
+			assert.Equal(t, tc.node, resp)
+			if tc.node == "" {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestFindAvailableNodeAntiAffinity(t *testing.T) {
+	gig := 1024 * 1024 * 1024
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/lxc") {
+			fmt.Fprint(w, `{"data":[]}`)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/nodes/pve1/qemu") {
+			fmt.Fprint(w, `{"data":[{"vmid":100,"status":"stopped","tags":"other;rancher-cp"}]}`)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/nodes/pve2/qemu") {
+			fmt.Fprint(w, `{"data":[{"vmid":101,"status":"stopped","tags":"rancher-cp"},{"vmid":102,"status":"stopped","tags":"rancher-cp"}]}`)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/nodes") {
+			fmt.Fprintf(w, `{"data":[{"node":"pve1","maxmem":%d,"maxcpu":8,"status":"online"},{"node":"pve2","maxmem":%d,"maxcpu":8,"status":"online"}]}`, 16*gig, 32*gig)
+			return
+		}
+	}))
+	defer s.Close()
+
+	tests := map[string]struct {
+		driver *Driver
+		node   string
+	}{
+		"no key":          {driver: &Driver{}, node: "pve2"},
+		"key":             {driver: &Driver{AntiAffinityKey: "Rancher CP"}, node: "pve1"},
+		"strict conflict": {driver: &Driver{AntiAffinityKey: "rancher-cp", AntiAffinityStrict: true}},
+		"strict":          {driver: &Driver{AntiAffinityKey: "rancher-workers", AntiAffinityStrict: true}, node: "pve2"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := tc.driver
+			d.AnyNode = true
+			d.Memory = 1024
+			d.CPUCores = 1
+			d.client = proxmox.NewClient(s.URL)
+			resp, err := d.findAvailableNode(context.Background())
+			assert.Equal(t, tc.node, resp)
+			if tc.node == "" {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -3,14 +3,15 @@ package driver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/FreekingDean/proxmox-api-go/proxmox"
-	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster"
 	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
 	ignition "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/labstack/gommon/log"
 )
 
 // PreCreateCheck is called to enforce pre-creation steps
@@ -23,33 +24,192 @@ func (d *Driver) PreCreateCheck() error {
 	return nil
 }
 
-// Create creates a new VM with storage
+// Create creates a new VM with storage. Its progress is checkpointed in the
+// machine store, so rerunning Create after it died part way, e.g. through the
+// finish-create command, resumes with the VM it already created.
 func (d *Driver) Create() error {
+	ctx, stop := signalContext()
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, d.createTimeout())
+	defer cancel()
+
 	d.debug("Creating Client")
 	c, err := d.EnsureClient()
 	if err != nil {
 		return err
 	}
 
-	d.debug("getting next vmid")
-	cclient := cluster.New(c)
-	id, err := cclient.Nextid(context.Background(), cluster.NextidRequest{})
+	if d.Adopt != "" {
+		return d.adopt(ctx)
+	}
+
+	cp, err := d.resumeCheckpoint(ctx)
 	if err != nil {
 		return err
 	}
+	dangling := cp.has(stepCreated)
+	defer func() {
+		if !dangling {
+			return
+		}
+		if ctx.Err() != nil {
+			// interrupted or out of time, docker-machine may be gone already
+			d.discard()
+			return
+		}
+		err := d.remove(context.Background())
+		if err != nil {
+			log.Warnf("Could not remove VM %d of the failed create, remove the machine to retry: %v", d.VMID, err)
+		}
+	}()
+
+	if !cp.has(stepCreated) {
+		req, err := d.createRequest(ctx)
+		if err != nil {
+			return err
+		}
+		d.debug("creating vm")
+		dangling, err = d.createVM(ctx, c, req, cp)
+		if err != nil {
+			return err
+		}
+		err = cp.done(stepCreated)
+		if err != nil {
+			return err
+		}
+	}
+	err = d.SaveMachine()
+	if err != nil {
+		return fmt.Errorf("could not record vm %d in the machine store: %w", d.VMID, err)
+	}
+	q := qemu.New(c)
+
+	// resize disk
+	if d.ScsiDiskSize != 0 && !cp.has(stepResized) {
+		// allow machine to settle
+		err = sleep(ctx, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		err = d.retry(ctx, defaultBackoff, func() error {
+			return q.ResizeVm(ctx, qemu.ResizeVmRequest{
+				Disk: "scsi0",
+				Node: d.Node,
+				Vmid: d.VMID,
+				Size: fmt.Sprintf("%dG", d.ScsiDiskSize),
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = cp.done(stepResized)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !cp.has(stepStarted) {
+		// start the VM
+		err = d.start(ctx)
+		if err != nil {
+			return err
+		}
+		err = cp.done(stepStarted)
+		if err != nil {
+			return err
+		}
+
+		// let VM start a settle a little
+		d.debugf("waiting for VM to start, wait 10 seconds")
+		err = sleep(ctx, 10*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+
+	// wait for network to come up
+	err = d.waitForNetwork(ctx)
+	if err != nil {
+		return err
+	}
+	err = d.writeKnownHosts()
+	if err != nil {
+		return err
+	}
+	err = d.waitForGuest(ctx)
+	if err != nil {
+		return err
+	}
+	// ignition has run, drop its config holding the private host key
+	err = d.clearIgnition(ctx)
+	if err != nil {
+		return err
+	}
+
+	if d.HAEnabled && !cp.has(stepHA) {
+		err = d.registerHA(ctx)
+		if err != nil {
+			return err
+		}
+		err = cp.done(stepHA)
+		if err != nil {
+			return err
+		}
+	}
+
+	// removing the VM purges it from backup jobs again
+	if d.BackupJob != "" && !cp.has(stepBackupJob) {
+		err = d.addToBackupJob(ctx, d.BackupJob)
+		if err != nil {
+			return err
+		}
+		err = cp.done(stepBackupJob)
+		if err != nil {
+			return err
+		}
+	}
+
+	// protect last, so a failed create can still clean up after itself
+	if d.Protection {
+		err = d.protect(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	dangling = false
+	cp.clear()
+	return nil
+}
+
+// createRequest generates the machine's keys and ignition config and chooses
+// its node, returning the request creating its VM
+func (d *Driver) createRequest(ctx context.Context) (qemu.CreateRequest, error) {
 	tvalue := true
 
+	var err error
+	if d.MachineID == "" {
+		d.MachineID, err = newMachineID()
+		if err != nil {
+			return qemu.CreateRequest{}, err
+		}
+	}
+
 	keys, err := d.importSSHKeys()
 	if err != nil {
-		return err
+		return qemu.CreateRequest{}, err
 	}
 
 	d.debug("gen keys")
 	key, err := d.generateKey()
 	if err != nil {
-		return err
+		return qemu.CreateRequest{}, err
 	}
 	keys = append(keys, ignition.SSHAuthorizedKey(key))
+
+	hostKeyFiles, err := d.hostKeyFiles()
+	if err != nil {
+		return qemu.CreateRequest{}, err
+	}
 	systemd := `
 [Unit]
 Description=Layer qemu-guest-agent with rpm-ostree
@@ -78,6 +238,9 @@ WantedBy=multi-user.target
 				},
 			},
 		},
+		Storage: ignition.Storage{
+			Files: hostKeyFiles,
+		},
 		Passwd: ignition.Passwd{
 			Users: []ignition.PasswdUser{
 				ignition.PasswdUser{
@@ -94,25 +257,22 @@ WantedBy=multi-user.target
 
 	cfgStr, err := json.Marshal(cfg)
 	if err != nil {
-		return err
+		return qemu.CreateRequest{}, err
 	}
 
-	d.debugf("Next ID is '%d'", id)
 	fwstr := fmt.Sprintf(
 		"name=opt/com.coreos/config,string='%s'",
 		strings.Replace(string(cfgStr), ",", ",,", -1),
 	)
 
-	node, err := d.findAvailableNode()
+	node, err := d.findAvailableNode(ctx)
 	if err != nil {
-		return err
+		return qemu.CreateRequest{}, err
 	}
 	d.Node = node
-	d.debugf("Available node is '%d'", node)
+	d.debugf("Available node is '%s'", node)
 
-	d.VMID = id
 	req := qemu.CreateRequest{
-		Vmid:   d.VMID,
 		Args:   proxmox.String(fmt.Sprintf("-fw_cfg %s", fwstr)),
 		Name:   proxmox.String(d.GetMachineName()),
 		Node:   d.Node,
@@ -131,6 +291,7 @@ WantedBy=multi-user.target
 		},
 		Serials: &qemu.Serials{proxmox.String("socket")},
 	}
+	req.Tags = proxmox.String(strings.Join(d.vmTags(), ";"))
 
 	if d.Scsi != "" {
 		d.debug("Adding scsi0")
@@ -143,104 +304,76 @@ WantedBy=multi-user.target
 		}
 		req.Scsis = &qemu.Scsis{scsi}
 	}
-	q := qemu.New(c)
-	taskID, err := q.Create(context.Background(), req)
+	return req, nil
+}
+
+// clearIgnition removes the ignition config passed through args from the VM
+// config, as it is only read on first boot but holds the private host key
+func (d *Driver) clearIgnition(ctx context.Context) error {
+	c, err := d.EnsureClient()
 	if err != nil {
 		return err
 	}
-	dangling := true
-	defer func() {
-		if dangling {
-			err = d.Remove()
-			if err != nil {
-				d.debugf("Error removing dangling resource: %w", err)
-			}
-		}
-	}()
-	err = d.waitForTaskToComplete(taskID, 2*time.Minute)
-	if err != nil {
-		return err
+	return d.withVMNode(func() error {
+		return qemu.New(c).UpdateVmConfig(ctx, qemu.UpdateVmConfigRequest{
+			Node:   d.Node,
+			Vmid:   d.VMID,
+			Delete: proxmox.String("args"),
+		})
+	})
+}
+
+// vmTags returns the tags to apply to a newly created VM
+func (d *Driver) vmTags() []string {
+	tags := []string{driverTag, d.machineIDTag()}
+	if tag := sanitizeTag(d.AntiAffinityKey); tag != "" {
+		tags = append(tags, tag)
 	}
+	return tags
+}
 
-	// resize disk
-	if d.ScsiDiskSize != 0 {
-		// allow machine to settle
-		time.Sleep(10 * time.Second)
-		err = d.retry(func() error {
-			return q.ResizeVm(context.Background(), qemu.ResizeVmRequest{
-				Disk: "scsi0",
-				Node: d.Node,
-				Vmid: d.VMID,
-				Size: fmt.Sprintf("%dG", d.ScsiDiskSize),
-			})
-		}, 10*time.Second, 10)
+func (d *Driver) waitForNetwork(ctx context.Context) error {
+	// time for startup, qemu install, and network to come online
+	b := backoff{
+		Initial:    2 * time.Second,
+		Max:        15 * time.Second,
+		Jitter:     0.2,
+		MaxElapsed: d.networkTimeout(),
+		Retryable: func(err error) bool {
+			// the agent answers with an error until it is running
+			return errors.Is(err, errNoIP) || isRetryable(err)
+		},
+	}
+	err := d.retry(ctx, b, func() error {
+		ip, err := d.getVMIp(ctx)
 		if err != nil {
 			return err
 		}
-	}
-
-	// start the VM
-	err = d.Start()
-	if err != nil {
-		return err
-	}
-
-	// let VM start a settle a little
-	d.debugf("waiting for VM to start, wait 10 seconds")
-	time.Sleep(10 * time.Second)
-
-	// wait for network to come up
-	err = d.waitForNetwork()
+		if ip == "" {
+			d.debugf("waiting for VM network to start")
+			return errNoIP
+		}
+		d.IPAddress = ip
+		return nil
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("failed waiting for IP: %w", err)
 	}
-	dangling = false
 	return nil
 }
 
-// Remove removes the VM
-func (d *Driver) Remove() error {
-	if d.VMID < 1 {
-		return nil
-	}
-	// force shut down VM before invoking delete
-	err := d.Kill()
-	if err != nil {
-		d.debug("error stopping vm " + err.Error())
-	}
+var errNoIP = errors.New("no IP address reported yet")
 
-	c, err := d.EnsureClient()
-	if err != nil {
-		return err
+func (d *Driver) createTimeout() time.Duration {
+	if d.CreateTimeout <= 0 {
+		return 30 * time.Minute
 	}
-	q := qemu.New(c)
-
-	taskID, err := q.Delete(context.Background(), qemu.DeleteRequest{
-		Vmid:                     d.VMID,
-		Node:                     d.Node,
-		DestroyUnreferencedDisks: proxmox.PVEBool(true),
-		Purge:                    proxmox.PVEBool(true),
-	})
-	if err != nil {
-		return err
-	}
-	return d.waitForTaskToComplete(taskID, 10*time.Minute)
+	return time.Duration(d.CreateTimeout) * time.Second
 }
 
-func (d *Driver) waitForNetwork() error {
-	// attempt over 5 minutes
-	// time for startup, qemu install, and network to come online
-	for i := 0; i < 60; i++ {
-		ip, err := d.getVMIp()
-		if err != nil {
-			return err
-		}
-		if ip != "" {
-			d.IPAddress = ip
-			return nil
-		}
-		d.debugf("waiting for VM network to start")
-		time.Sleep(5 * time.Second)
+func (d *Driver) networkTimeout() time.Duration {
+	if d.NetworkTimeout <= 0 {
+		return 5 * time.Minute
 	}
-	return fmt.Errorf("failed waiting for IP")
+	return time.Duration(d.NetworkTimeout) * time.Second
 }
@@ -2,10 +2,13 @@ package driver
 
 import (
 	"fmt"
+	"net"
+	"sync"
 
 	"github.com/docker/machine/libmachine/drivers"
 
 	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"golang.org/x/crypto/ssh"
 )
 
 // Driver for Proxmox VE
@@ -23,9 +26,28 @@ type Driver struct {
 	Realm    string // realm, e.g. pam, pve, etc.
 
 	// VM Placement Information
-	Node  string // optional, node to create VM, must supply either Node or Group this takes precedence over Group if both are set
-	Group string // optional, the HA group to use, must supply either Node or Group
-	Pool  string // pool
+	Node         string // optional, node to create VM, takes precedence over all other placement options
+	Group        string // optional, the HA group to schedule across
+	NodeList     string // optional, comma separated nodes to schedule across when Group is unset
+	NodeSelector string // optional, regex nodes names must match to be scheduled on
+	AnyNode      bool   // optional, schedule across all online nodes when no Group or NodeList is set
+	Pool         string // pool
+
+	// Register the VM as an HA resource in Group
+	HAEnabled     bool   // register the VM with HA after creation
+	HAState       string // requested HA resource state, e.g. started
+	HAMaxRestart  int    // restart attempts on the same node
+	HAMaxRelocate int    // relocation attempts to other nodes
+
+	// Spread VMs sharing a key across nodes, the key is stored as a tag on the VM
+	AntiAffinityKey    string // optional, e.g. the rancher pool or cluster name
+	AntiAffinityStrict bool   // fail rather than placing onto a node already hosting the key
+
+	// Placement capacity tuning used when automatically choosing a node
+	PlacementUseNodeMem bool    // use the node's reported memory usage instead of summing guest allocations
+	HostReservedMem     int     // memory in MB kept free for the host
+	CPUOvercommit       float64 // ratio of guest cores to physical cores allowed
+	MemOvercommit       float64 // ratio of guest memory to physical memory allowed
 
 	// File to load as boot image FedoraCoreOS
 	Scsi         string //Scsi0 data
@@ -35,10 +57,56 @@ type Driver struct {
 	Memory   int // memory in GB
 	CPUCores int // The number of cores per socket.
 
+	ShutdownTimeout int // seconds to wait for a graceful shutdown before forcing the VM off
+	CreateTimeout   int // seconds Create may take in total
+	NetworkTimeout  int // seconds to wait for the VM to report an IP
+	TaskTimeout     int // seconds to wait for each Proxmox task, 0 uses per operation defaults
+
+	// Automatic snapshots ahead of risky operations
+	SnapshotBeforeUpgrade bool // snapshot before Upgrade
+	SnapshotBeforeRestart bool // snapshot before Restart
+	SnapshotWithRAM       bool // include RAM in automatic snapshots
+	SnapshotFreezeFS      bool // freeze guest filesystems through the agent while snapshotting
+	SnapshotRetention     int  // automatic snapshots to keep, 0 keeps all
+
+	BackupJob string // optional, existing backup job to add the VM to
+
 	NetBridge  string // bridge applied to network interface
 	NetVlanTag int    // vlan tag
 
-	SSHImportID string // SSH Import ID Keys
+	SSHImportID        string // SSH Import ID Keys, comma separated sources
+	SSHImportGitLabURL string // base URL for gl: key sources
+	SSHImportTimeout   int    // seconds to wait for each key source
+	SSHKeyFile         string // optional, existing private key to use instead of generating one
+	SSHKeyType         string // type of generated keys, rsa or ed25519
+	SSHHostKey         string // (generated) pinned public host key of the VM
+
+	// Bastion to reach the VM through over SSH
+	SSHJumpHost        string // optional, [user@]host[:port]
+	SSHJumpUser        string // optional, overrides the user in SSHJumpHost
+	SSHJumpKeyPath     string // private key for the jump host, required with SSHJumpHost
+	SSHJumpKnownHosts  string // optional, known_hosts to verify the jump host with, defaults to ~/.ssh/known_hosts
+	SSHJumpFingerprint string // optional, SHA256 fingerprint of the jump host key, instead of known_hosts
+
+	jumpMu  sync.Mutex // guards jump and forward
+	jump    *ssh.Client
+	forward net.Listener
+
+	CommandChannel string // how to run commands in the guest: auto, ssh or agent
+
+	VMIDRange    string // optional, MIN-MAX range to allocate the VMID from
+	VMIDFromName bool   // derive the first VMID tried from the machine name
+
+	MachineID string // (generated) ID tagged onto the VM to recognise it
+
+	// Adopt an existing VM instead of creating one
+	Adopt          string // optional, VMID or name of the VM to adopt
+	AdoptInjectKey bool   // authorize the machine's SSH key through the guest agent
+	VMName         string // (generated) name of an adopted VM, if not the machine name
+
+	Protection        bool // set the Proxmox VE protection flag on the VM
+	KeepDataDisks     bool // detach and keep all disks but the boot disk on remove
+	KeepDataDisksVMID int  // optional, VM to move data disks owned by the VM to on remove
 
 	VMID        int  // (generated) Proxmox VM ID
 	driverDebug bool // driver debugging
@@ -69,12 +137,61 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 
 	d.Node = flags.String(flagProxmoxNode)
 	d.Group = flags.String(flagProxmoxGroup)
+	d.NodeList = flags.String(flagProxmoxNodeList)
+	d.NodeSelector = flags.String(flagProxmoxNodeSelector)
+	d.AnyNode = flags.Bool(flagProxmoxAnyNode)
 	d.Pool = flags.String(flagProxmoxPool)
+	d.AntiAffinityKey = flags.String(flagProxmoxAntiAffinityKey)
+	d.AntiAffinityStrict = flags.Bool(flagProxmoxAntiAffinityStrict)
+
+	d.HAEnabled = flags.Bool(flagProxmoxHA)
+	d.HAState = flags.String(flagProxmoxHAState)
+	d.HAMaxRestart = flags.Int(flagProxmoxHAMaxRestart)
+	d.HAMaxRelocate = flags.Int(flagProxmoxHAMaxRelocate)
+
+	d.PlacementUseNodeMem = flags.Bool(flagProxmoxPlacementUseNodeMem)
+	d.HostReservedMem = flags.Int(flagProxmoxHostReservedMem)
+	d.HostReservedMem *= 1024
+	var err error
+	d.CPUOvercommit, err = parseRatio(flags.String(flagProxmoxCPUOvercommit))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", flagProxmoxCPUOvercommit, err)
+	}
+	d.MemOvercommit, err = parseRatio(flags.String(flagProxmoxMemOvercommit))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", flagProxmoxMemOvercommit, err)
+	}
 
 	// VM configuration
 	d.Memory = flags.Int(flagVMMemory)
 	d.Memory *= 1024
 	d.CPUCores = flags.Int(flagVMCores)
+	d.ShutdownTimeout = flags.Int(flagVMShutdownTimeout)
+	d.CreateTimeout = flags.Int(flagVMCreateTimeout)
+	d.NetworkTimeout = flags.Int(flagVMNetworkTimeout)
+	d.TaskTimeout = flags.Int(flagProxmoxTaskTimeout)
+	d.SnapshotBeforeUpgrade = flags.Bool(flagVMSnapshotBeforeUpgrade)
+	d.SnapshotBeforeRestart = flags.Bool(flagVMSnapshotBeforeRestart)
+	d.SnapshotWithRAM = flags.Bool(flagVMSnapshotWithRAM)
+	d.SnapshotFreezeFS = flags.Bool(flagVMSnapshotFreezeFS)
+	if d.SnapshotFreezeFS && d.SnapshotWithRAM {
+		return fmt.Errorf("%s: %w", flagVMSnapshotWithRAM, errFreezeWithRAM)
+	}
+	d.SnapshotRetention = flags.Int(flagVMSnapshotRetention)
+	d.BackupJob = flags.String(flagVMBackupJob)
+	d.VMIDRange = flags.String(flagVMIDRange)
+	if _, _, err := parseVMIDRange(d.VMIDRange); err != nil {
+		return err
+	}
+	d.VMIDFromName = flags.Bool(flagVMIDFromName)
+	d.Adopt = flags.String(flagVMAdopt)
+	d.AdoptInjectKey = flags.Bool(flagVMAdoptInjectKey)
+	d.Protection = flags.Bool(flagVMProtection)
+	d.KeepDataDisks = flags.Bool(flagVMKeepDataDisks)
+	d.KeepDataDisksVMID = flags.Int(flagVMKeepDataDisksVMID)
+	if d.KeepDataDisksVMID > 0 && !d.KeepDataDisks {
+		return fmt.Errorf("%s requires %s", flagVMKeepDataDisksVMID, flagVMKeepDataDisks)
+	}
 	d.Scsi = flags.String(flagVMSCSIFilename)
 	d.ScsiImport = flags.String(flagVMSCSIImport)
 	d.ScsiDiskSize = flags.Int(flagVMSCSISize)
@@ -83,7 +200,30 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 
 	d.SSHUser = flags.String(flagSSHUsername)
 	d.SSHImportID = flags.String(flagSSHImportID)
+	d.SSHImportGitLabURL = flags.String(flagSSHImportGitLabURL)
+	d.SSHImportTimeout = flags.Int(flagSSHImportTimeout)
 	d.SSHPort = flags.Int(flagSSHPort)
+	d.SSHKeyFile = flags.String(flagSSHKey)
+	d.SSHKeyType = flags.String(flagSSHKeyType)
+	switch d.SSHKeyType {
+	case keyTypeRSA, keyTypeEd25519:
+	default:
+		return fmt.Errorf("invalid %s '%s', expected one of rsa, ed25519", flagSSHKeyType, d.SSHKeyType)
+	}
+	d.SSHJumpHost = flags.String(flagSSHJumpHost)
+	d.SSHJumpUser = flags.String(flagSSHJumpUser)
+	d.SSHJumpKeyPath = flags.String(flagSSHJumpKey)
+	d.SSHJumpKnownHosts = flags.String(flagSSHJumpKnownHosts)
+	d.SSHJumpFingerprint = flags.String(flagSSHJumpFingerprint)
+	if d.SSHJumpHost != "" && d.SSHJumpKeyPath == "" {
+		return fmt.Errorf("%s requires %s", flagSSHJumpHost, flagSSHJumpKey)
+	}
+	d.CommandChannel = flags.String(flagCommandChannel)
+	switch d.CommandChannel {
+	case channelAuto, channelSSH, channelAgent:
+	default:
+		return fmt.Errorf("invalid %s '%s', expected one of auto, ssh, agent", flagCommandChannel, d.CommandChannel)
+	}
 
 	//Debug option
 	d.driverDebug = flags.Bool(flagDebug)
@@ -100,12 +240,14 @@ func (d *Driver) GetURL() (string, error) {
 	return fmt.Sprintf("tcp://%s:2376", ip), nil
 }
 
-// GetSSHHostname returns the ssh host returned by the API
+// GetSSHHostname returns the ssh host returned by the API, or the local end
+// of the tunnel when going through a jump host
 func (d *Driver) GetSSHHostname() (string, error) {
+	if d.SSHJumpHost != "" {
+		if _, err := d.sshForward(); err != nil {
+			return "", err
+		}
+		return "127.0.0.1", nil
+	}
 	return d.GetIP()
 }
-
-// Upgrade is currently a NOOP
-func (d *Driver) Upgrade() error {
-	return nil
-}
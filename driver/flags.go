@@ -12,22 +12,69 @@ const (
 	flagProxmoxUserPassword = "proxmoxve-proxmox-user-password"
 	flagProxmoxRealm        = "proxmoxve-proxmox-realm"
 
-	flagProxmoxNode  = "proxmoxve-proxmox-node"
-	flagProxmoxGroup = "proxmoxve-proxmox-group"
-	flagProxmoxPool  = "proxmoxve-proxmox-pool"
+	flagProxmoxNode         = "proxmoxve-proxmox-node"
+	flagProxmoxGroup        = "proxmoxve-proxmox-group"
+	flagProxmoxNodeList     = "proxmoxve-proxmox-node-list"
+	flagProxmoxNodeSelector = "proxmoxve-proxmox-node-selector"
+	flagProxmoxAnyNode      = "proxmoxve-proxmox-any-node"
+	flagProxmoxPool         = "proxmoxve-proxmox-pool"
+
+	flagProxmoxHA            = "proxmoxve-proxmox-ha"
+	flagProxmoxHAState       = "proxmoxve-proxmox-ha-state"
+	flagProxmoxHAMaxRestart  = "proxmoxve-proxmox-ha-max-restart"
+	flagProxmoxHAMaxRelocate = "proxmoxve-proxmox-ha-max-relocate"
+
+	flagProxmoxAntiAffinityKey    = "proxmoxve-proxmox-anti-affinity-key"
+	flagProxmoxAntiAffinityStrict = "proxmoxve-proxmox-anti-affinity-strict"
+
+	flagProxmoxPlacementUseNodeMem = "proxmoxve-proxmox-placement-use-node-mem"
+	flagProxmoxHostReservedMem     = "proxmoxve-proxmox-host-reserved-mem"
+	flagProxmoxCPUOvercommit       = "proxmoxve-proxmox-cpu-overcommit"
+	flagProxmoxMemOvercommit       = "proxmoxve-proxmox-mem-overcommit"
+	flagProxmoxTaskTimeout         = "proxmoxve-proxmox-task-timeout"
+
+	flagVMMemory            = "proxmoxve-vm-memory"
+	flagVMCores             = "proxmoxve-vm-cores"
+	flagVMIDRange           = "proxmoxve-vm-id-range"
+	flagVMIDFromName        = "proxmoxve-vm-id-from-name"
+	flagVMAdopt             = "proxmoxve-vm-adopt"
+	flagVMAdoptInjectKey    = "proxmoxve-vm-adopt-inject-key"
+	flagVMProtection        = "proxmoxve-vm-protection"
+	flagVMKeepDataDisks     = "proxmoxve-vm-keep-data-disks"
+	flagVMKeepDataDisksVMID = "proxmoxve-vm-keep-data-disks-vmid"
+	flagVMShutdownTimeout   = "proxmoxve-vm-shutdown-timeout"
+	flagVMCreateTimeout     = "proxmoxve-vm-create-timeout"
+	flagVMNetworkTimeout    = "proxmoxve-vm-network-timeout"
+
+	flagVMSnapshotBeforeUpgrade = "proxmoxve-vm-snapshot-before-upgrade"
+	flagVMSnapshotBeforeRestart = "proxmoxve-vm-snapshot-before-restart"
+	flagVMSnapshotWithRAM       = "proxmoxve-vm-snapshot-with-ram"
+	flagVMSnapshotFreezeFS      = "proxmoxve-vm-snapshot-freeze-fs"
+	flagVMSnapshotRetention     = "proxmoxve-vm-snapshot-retention"
+	flagVMBackupJob             = "proxmoxve-vm-backup-job"
 
-	flagVMMemory       = "proxmoxve-vm-memory"
-	flagVMCores        = "proxmoxve-vm-cores"
 	flagVMSCSIFilename = "proxmoxve-vm-scsi"
 	flagVMSCSIImport   = "proxmoxve-vm-scsi-import"
 	flagVMSCSISize     = "proxmoxve-vm-scsi-size"
 	flagVMNetBridge    = "proxmoxve-vm-net-bridge"
 	flagVMNetTag       = "proxmoxve-vm-net-tag"
 
-	flagSSHUsername = "proxmoxve-ssh-username"
-	flagSSHPort     = "proxmoxve-ssh-port"
-	flagSSHImportID = "proxmoxve-ssh-import-id"
-	flagDebug       = "proxmoxve-debug-driver"
+	flagSSHUsername        = "proxmoxve-ssh-username"
+	flagSSHPort            = "proxmoxve-ssh-port"
+	flagSSHImportID        = "proxmoxve-ssh-import-id"
+	flagSSHImportGitLabURL = "proxmoxve-ssh-import-gitlab-url"
+	flagSSHImportTimeout   = "proxmoxve-ssh-import-timeout"
+	flagSSHKey             = "proxmoxve-ssh-key"
+	flagSSHKeyType         = "proxmoxve-ssh-key-type"
+	flagSSHJumpHost        = "proxmoxve-ssh-jump-host"
+	flagSSHJumpUser        = "proxmoxve-ssh-jump-user"
+	flagSSHJumpKey         = "proxmoxve-ssh-jump-key"
+	flagSSHJumpKnownHosts  = "proxmoxve-ssh-jump-known-hosts"
+	flagSSHJumpFingerprint = "proxmoxve-ssh-jump-fingerprint"
+
+	flagCommandChannel = "proxmoxve-command-channel"
+
+	flagDebug = "proxmoxve-debug-driver"
 )
 
 // GetCreateFlags returns the argument flags for the program
@@ -40,10 +87,44 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 
 		stringFlag(flagProxmoxNode, "Node name to launch VMs on", ""),
 		stringFlag(flagProxmoxGroup, "Group to schedule VMs to (only enabled if Node is unset)", ""),
+		stringFlag(flagProxmoxNodeList, "Comma separated nodes to schedule VMs to (only enabled if Node and Group are unset)", ""),
+		stringFlag(flagProxmoxNodeSelector, "Regex node names must match to schedule VMs to", ""),
+		boolFlag(flagProxmoxAnyNode, "Schedule VMs to any online node (only enabled if Node, Group and Node List are unset)"),
 		stringFlag(flagProxmoxPool, "Pool to attach to VMs", ""),
 
+		boolFlag(flagProxmoxHA, "Register VMs as HA resources (in Group if set)"),
+		stringFlag(flagProxmoxHAState, "HA resource requested state (started, stopped, enabled, disabled, ignored)", "started"),
+		intFlag(flagProxmoxHAMaxRestart, "HA maximal restart tries on the same node", 1),
+		intFlag(flagProxmoxHAMaxRelocate, "HA maximal relocate tries to other nodes", 1),
+
+		stringFlag(flagProxmoxAntiAffinityKey, "Tag VMs with this key and prefer nodes hosting the fewest VMs sharing it", ""),
+		boolFlag(flagProxmoxAntiAffinityStrict, "Fail rather than place a VM on a node already hosting its anti-affinity key"),
+
+		boolFlag(flagProxmoxPlacementUseNodeMem, "Use the node's reported memory usage for placement"),
+		intFlag(flagProxmoxHostReservedMem, "Memory in GB to keep free on each node for the host", 0),
+		stringFlag(flagProxmoxCPUOvercommit, "Ratio of VM cores to node cores allowed during placement", "1.0"),
+		stringFlag(flagProxmoxMemOvercommit, "Ratio of VM memory to node memory allowed during placement", "1.0"),
+		intFlag(flagProxmoxTaskTimeout, "Seconds to wait for each Proxmox task, 0 uses a default per operation", 0),
+
 		intFlag(flagVMMemory, "VM Memory in GB", 8),
 		intFlag(flagVMCores, "VM CPU Cores", 2),
+		stringFlag(flagVMIDRange, "VMID range to allocate from as MIN-MAX, e.g. one range per pool", ""),
+		boolFlag(flagVMIDFromName, "Derive the VMID from the machine name, moving on to the next free VMID if taken"),
+		stringFlag(flagVMAdopt, "VMID or name of an existing VM to adopt instead of creating one", ""),
+		boolFlag(flagVMAdoptInjectKey, "Authorize the machine's SSH key in the adopted VM through the guest agent"),
+		boolFlag(flagVMProtection, "Protect the VM from deletion in Proxmox VE"),
+		boolFlag(flagVMKeepDataDisks, "Detach and keep all disks but the boot disk when removing the VM"),
+		intFlag(flagVMKeepDataDisksVMID, "VMID of a VM on the same node to move data disks owned by the removed VM to", 0),
+		intFlag(flagVMShutdownTimeout, "Seconds to wait for a graceful shutdown before forcing the VM off", 600),
+		intFlag(flagVMCreateTimeout, "Seconds the whole VM creation may take before it is cancelled and cleaned up", 1800),
+		intFlag(flagVMNetworkTimeout, "Seconds to wait for the VM to report an IP address", 300),
+
+		boolFlag(flagVMSnapshotBeforeUpgrade, "Snapshot the VM before upgrading"),
+		boolFlag(flagVMSnapshotBeforeRestart, "Snapshot the VM before restarting"),
+		boolFlag(flagVMSnapshotWithRAM, "Include RAM in automatic snapshots"),
+		boolFlag(flagVMSnapshotFreezeFS, "Require the guest agent so filesystems are frozen while snapshotting (not with RAM)"),
+		intFlag(flagVMSnapshotRetention, "Automatic snapshots to keep per machine (0 keeps all)", 0),
+		stringFlag(flagVMBackupJob, "Existing backup job ID to add VMs to", ""),
 
 		stringFlag(flagVMSCSIFilename, "VM SCSI0 Filename", ""),
 		stringFlag(flagVMSCSIImport, "VM SCSI0 Disk to Import", ""),
@@ -53,8 +134,18 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		intFlag(flagVMNetTag, "VM VLAN Tag", 0),
 
 		stringFlag(flagSSHUsername, "SSH Username", "rancher"),
-		stringFlag(flagSSHImportID, "SSH Import ID (ie gh:GithubUsername)", ""),
+		stringFlag(flagSSHImportID, "SSH Import IDs, comma separated (ie gh:GithubUsername,gl:GitlabUsername,lp:LaunchpadUsername,url:https://host/keys,file:/path/authorized_keys)", ""),
+		stringFlag(flagSSHImportGitLabURL, "GitLab base URL for gl: SSH Import IDs", defaultGitLabURL),
+		intFlag(flagSSHImportTimeout, "Seconds to wait for each SSH Import ID source", 30),
 		intFlag(flagSSHPort, "SSH Port", 22),
+		stringFlag(flagSSHKey, "Existing private key to use for the machine instead of generating one, copied into the machine store", ""),
+		stringFlag(flagSSHKeyType, "Type of key to generate: rsa or ed25519", keyTypeRSA),
+		stringFlag(flagSSHJumpHost, "Jump host to reach the VM through over SSH, as [user@]host[:port]", ""),
+		stringFlag(flagSSHJumpUser, "User on the jump host, overrides the user in the jump host address", ""),
+		stringFlag(flagSSHJumpKey, "Private key for the jump host, required with a jump host", ""),
+		stringFlag(flagSSHJumpKnownHosts, "known_hosts file to verify the jump host with, defaults to ~/.ssh/known_hosts", ""),
+		stringFlag(flagSSHJumpFingerprint, "SHA256 fingerprint of the jump host key, used instead of known_hosts", ""),
+		stringFlag(flagCommandChannel, "Channel for driver commands in the guest: auto (SSH, or the guest agent when SSH is unreachable), ssh or agent", channelAuto),
 		boolFlag(flagDebug, "Debug driver"),
 	}
 }
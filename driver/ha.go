@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster/ha/resources"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster/ha/status"
+)
+
+func (d *Driver) haSid() string {
+	return fmt.Sprintf("vm:%d", d.VMID)
+}
+
+// registerHA adds the VM as an HA resource in the configured group
+func (d *Driver) registerHA(ctx context.Context) error {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	d.debugf("registering %s as HA resource", d.haSid())
+	req := resources.CreateRequest{
+		Sid:         d.haSid(),
+		Type:        resources.PtrType(resources.Type_VM),
+		Comment:     proxmox.String(fmt.Sprintf("docker-machine %s", d.GetMachineName())),
+		MaxRestart:  proxmox.Int(d.HAMaxRestart),
+		MaxRelocate: proxmox.Int(d.HAMaxRelocate),
+	}
+	if d.Group != "" {
+		req.Group = proxmox.String(d.Group)
+	}
+	if d.HAState != "" {
+		req.State = resources.PtrState(resources.State(d.HAState))
+	}
+	return resources.New(c).Create(ctx, req)
+}
+
+// unregisterHA removes the VM's HA resource, if it has one, and waits for the
+// HA manager to let go of the VM, so it may be stopped and destroyed without
+// being restarted
+func (d *Driver) unregisterHA(ctx context.Context) error {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	r := resources.New(c)
+	registered, err := r.Index(ctx, resources.IndexRequest{
+		Type: resources.PtrType(resources.Type_VM),
+	})
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, res := range registered {
+		if res.Sid == d.haSid() {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	d.debugf("removing HA resource %s", d.haSid())
+	err = r.Delete(ctx, resources.DeleteRequest{
+		Sid: d.haSid(),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	for {
+		services, err := status.New(c).StatusCurrent(ctx)
+		if err != nil {
+			return err
+		}
+		if !haManages(services, d.haSid()) {
+			return nil
+		}
+		err = sleep(ctx, time.Second)
+		if err != nil {
+			return fmt.Errorf("HA manager still manages %s: %w", d.haSid(), err)
+		}
+	}
+}
+
+// haManages reports whether the HA manager status lists the service sid
+func haManages(services []map[string]interface{}, sid string) bool {
+	for _, s := range services {
+		if s["type"] == "service" && s["sid"] == sid {
+			return true
+		}
+	}
+	return false
+}
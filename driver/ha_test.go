@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterHA(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/cluster/ha/resources", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		form, err := url.ParseQuery(string(body))
+		assert.NoError(t, err)
+		assert.Equal(t, "vm:123", form.Get("sid"))
+		assert.Equal(t, "some-group", form.Get("group"))
+		assert.Equal(t, "started", form.Get("state"))
+		assert.Equal(t, "2", form.Get("max_restart"))
+		assert.Equal(t, "3", form.Get("max_relocate"))
+		w.Write([]byte(`{"data":null}`))
+	}))
+	defer s.Close()
+	d := &Driver{
+		BaseDriver:    &drivers.BaseDriver{MachineName: "test"},
+		VMID:          123,
+		Group:         "some-group",
+		HAState:       "started",
+		HAMaxRestart:  2,
+		HAMaxRelocate: 3,
+		client:        proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.registerHA(context.Background()))
+}
+
+func TestUnregisterHA(t *testing.T) {
+	tests := map[string]struct {
+		resources string
+		deletes   int
+		polls     int
+	}{
+		"waits for manager": {resources: `[{"sid":"vm:100"},{"sid":"vm:123"}]`, deletes: 1, polls: 2},
+		"not HA managed":    {resources: `[{"sid":"vm:100"}]`},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			deletes, polls := 0, 0
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == "/cluster/ha/resources":
+					assert.Equal(t, "vm", r.URL.Query().Get("type"))
+					w.Write([]byte(`{"data":` + tc.resources + `}`))
+				case r.Method == http.MethodDelete && r.URL.Path == "/cluster/ha/resources/vm:123":
+					deletes++
+					if !strings.Contains(tc.resources, `"vm:123"`) {
+						// what Proxmox VE answers for VMs without an HA resource
+						writePVEError(t, w, 500, "cannot delete service 'vm:123', not HA managed!")
+						return
+					}
+					w.Write([]byte(`{"data":null}`))
+				case r.URL.Path == "/cluster/ha/status/current":
+					polls++
+					if polls < tc.polls {
+						w.Write([]byte(`{"data":[{"id":"quorum","type":"quorum"},{"id":"service:vm:123","type":"service","sid":"vm:123"}]}`))
+						return
+					}
+					w.Write([]byte(`{"data":[{"id":"quorum","type":"quorum"}]}`))
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer s.Close()
+			d := &Driver{
+				VMID:   123,
+				client: proxmox.NewClient(s.URL),
+			}
+			assert.NoError(t, d.unregisterHA(context.Background()))
+			assert.Equal(t, tc.deletes, deletes)
+			assert.Equal(t, tc.polls, polls)
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	ignition "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/docker/machine/libmachine/drivers"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const hostKeyPath = "/etc/ssh/ssh_host_ed25519_key"
+
+// hostKeyFiles generates the VM's ed25519 host key ahead of time, returning
+// the ignition files installing it and remembering its public half
+func (d *Driver) hostKeyFiles() ([]ignition.File, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate host key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, fmt.Errorf("could not encode host key: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode host key: %w", err)
+	}
+	pub := ssh.MarshalAuthorizedKey(signer.PublicKey())
+	d.SSHHostKey = strings.TrimSpace(string(pub))
+
+	return []ignition.File{
+		ignitionFile(hostKeyPath, pem.EncodeToMemory(block), 0600),
+		ignitionFile(hostKeyPath+".pub", pub, 0644),
+	}, nil
+}
+
+func ignitionFile(path string, content []byte, mode int) ignition.File {
+	overwrite := true
+	source := "data:;base64," + base64.StdEncoding.EncodeToString(content)
+	return ignition.File{
+		Node: ignition.Node{
+			Path:      path,
+			Overwrite: &overwrite,
+		},
+		FileEmbedded1: ignition.FileEmbedded1{
+			Contents: ignition.Resource{Source: &source},
+			Mode:     &mode,
+		},
+	}
+}
+
+// PinHostKey reads the VM's host key back through the guest agent and pins it,
+// for machines whose host key was not generated by the driver
+func (d *Driver) PinHostKey() error {
+	pub, err := d.PullFile(hostKeyPath + ".pub")
+	if err != nil {
+		return fmt.Errorf("could not read host key: %w", err)
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey(pub); err != nil {
+		return fmt.Errorf("invalid host key: %w", err)
+	}
+	d.SSHHostKey = strings.TrimSpace(string(pub))
+	return d.writeKnownHosts()
+}
+
+func (d *Driver) knownHostsPath() string {
+	return d.ResolveStorePath("known_hosts")
+}
+
+// writeKnownHosts records the pinned host key for the machine name and its
+// current IP in the machine store
+func (d *Driver) writeKnownHosts() error {
+	if d.SSHHostKey == "" {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(d.SSHHostKey))
+	if err != nil {
+		return fmt.Errorf("invalid host key: %w", err)
+	}
+	port, err := d.BaseDriver.GetSSHPort()
+	if err != nil {
+		return err
+	}
+	addrs := []string{net.JoinHostPort(d.GetMachineName(), strconv.Itoa(port))}
+	if d.IPAddress != "" {
+		addrs = append(addrs, net.JoinHostPort(d.IPAddress, strconv.Itoa(port)))
+	}
+	line := knownhosts.Line(addrs, pub) + "\n"
+	return os.WriteFile(d.knownHostsPath(), []byte(line), 0644)
+}
+
+// sshCommand runs cmd over SSH, verifying the host key against the machine's
+// known_hosts when one has been pinned
+func (d *Driver) sshCommand(cmd string) (string, error) {
+	if d.SSHHostKey == "" {
+		return drivers.RunSSHCommandFromDriver(d, cmd)
+	}
+
+	hostKeys, err := knownhosts.New(d.knownHostsPath())
+	if err != nil {
+		return "", fmt.Errorf("could not read known hosts: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(d.SSHHostKey))
+	if err != nil {
+		return "", fmt.Errorf("invalid host key: %w", err)
+	}
+	buf, err := os.ReadFile(d.GetSSHKeyPath())
+	if err != nil {
+		return "", fmt.Errorf("could not read ssh key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return "", fmt.Errorf("could not parse ssh key: %w", err)
+	}
+
+	port, err := d.BaseDriver.GetSSHPort()
+	if err != nil {
+		return "", err
+	}
+	conn, err := d.dialGuest(port)
+	if err != nil {
+		return "", err
+	}
+	// verify against the machine name so the pin survives IP changes
+	addr := net.JoinHostPort(d.GetMachineName(), strconv.Itoa(port))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:              d.GetSSHUsername(),
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: []string{pub.Type()},
+		Timeout:           10 * time.Second,
+	})
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	out, err := session.CombinedOutput(cmd)
+	return string(out), err
+}
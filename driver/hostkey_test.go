@@ -0,0 +1,74 @@
+package driver
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestHostKeyPinning(t *testing.T) {
+	d := newKeyTestDriver(t)
+	d.IPAddress = "10.0.0.5"
+
+	files, err := d.hostKeyFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, hostKeyPath, files[0].Path)
+	assert.Equal(t, 0600, *files[0].Mode)
+
+	// the injected private key matches the pinned public key
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(*files[0].Contents.Source, "data:;base64,"))
+	require.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey(buf)
+	require.NoError(t, err)
+	assert.Equal(t, d.SSHHostKey, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))))
+
+	require.NoError(t, d.writeKnownHosts())
+	check, err := knownhosts.New(d.knownHostsPath())
+	require.NoError(t, err)
+	remote := &net.TCPAddr{IP: net.ParseIP(d.IPAddress), Port: 22}
+	assert.NoError(t, check("test:22", remote, signer.PublicKey()))
+	assert.NoError(t, check("10.0.0.5:22", remote, signer.PublicKey()))
+
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherSigner, err := ssh.NewSignerFromKey(other)
+	require.NoError(t, err)
+	assert.Error(t, check("test:22", remote, otherSigner.PublicKey()))
+}
+
+func TestClearIgnition(t *testing.T) {
+	deleted := ""
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/nodes/pve1/qemu/100/config" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(body))
+		deleted = form.Get("delete")
+		w.Write([]byte(`{"data":null}`))
+	}))
+	defer s.Close()
+	d := &Driver{
+		Node:   "pve1",
+		VMID:   100,
+		client: proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.clearIgnition(context.Background()))
+	assert.Equal(t, "args", deleted)
+}
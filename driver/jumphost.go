@@ -0,0 +1,198 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// GetSSHPort returns the port docker-machine should ssh to, when a jump host
+// is configured this is the local end of a tunnel through it
+func (d *Driver) GetSSHPort() (int, error) {
+	if d.SSHJumpHost == "" {
+		return d.BaseDriver.GetSSHPort()
+	}
+	l, err := d.sshForward()
+	if err != nil {
+		return 0, err
+	}
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// dialGuest opens a connection to port on the VM, through the jump host if
+// one is configured
+func (d *Driver) dialGuest(port int) (net.Conn, error) {
+	addr := net.JoinHostPort(d.IPAddress, strconv.Itoa(port))
+	if d.SSHJumpHost == "" {
+		return net.DialTimeout("tcp", addr, 5*time.Second)
+	}
+	jump, err := d.jumpClient()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		// the jump connection may have dropped, reconnect on the next attempt
+		d.jumpMu.Lock()
+		if d.jump == jump {
+			d.jump.Close()
+			d.jump = nil
+		}
+		d.jumpMu.Unlock()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *Driver) jumpClient() (*ssh.Client, error) {
+	d.jumpMu.Lock()
+	defer d.jumpMu.Unlock()
+	if d.jump != nil {
+		return d.jump, nil
+	}
+
+	addr, username := parseJumpHost(d.SSHJumpHost)
+	if d.SSHJumpUser != "" {
+		username = d.SSHJumpUser
+	}
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("could not determine jump host user: %w", err)
+		}
+		username = u.Username
+	}
+
+	if d.SSHJumpKeyPath == "" {
+		return nil, fmt.Errorf("no key for jump host %s", addr)
+	}
+	buf, err := os.ReadFile(d.SSHJumpKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read jump host key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse jump host key: %w", err)
+	}
+
+	hostKeyCallback, err := d.jumpHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	d.debugf("connecting to jump host %s@%s", username, addr)
+	d.jump, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         10 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to jump host %s: %w", addr, err)
+	}
+	return d.jump, nil
+}
+
+// jumpHostKeyCallback verifies the jump host's key against
+// SSHJumpFingerprint or, without one, a known_hosts file which defaults to
+// ~/.ssh/known_hosts
+func (d *Driver) jumpHostKeyCallback() (ssh.HostKeyCallback, error) {
+	if d.SSHJumpFingerprint != "" {
+		want := d.SSHJumpFingerprint
+		if !strings.HasPrefix(want, "SHA256:") {
+			want = "SHA256:" + want
+		}
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); got != want {
+				return fmt.Errorf("jump host %s has key %s, expected %s", hostname, got, want)
+			}
+			return nil
+		}, nil
+	}
+
+	path := d.SSHJumpKnownHosts
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("could not find jump host known_hosts: %w", err)
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read jump host known_hosts: %w", err)
+	}
+	return callback, nil
+}
+
+// sshForward starts, once per process, a local listener tunneling to the VM's
+// ssh port through the jump host
+func (d *Driver) sshForward() (net.Listener, error) {
+	d.jumpMu.Lock()
+	defer d.jumpMu.Unlock()
+	if d.forward != nil {
+		return d.forward, nil
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	d.forward = l
+	go func() {
+		for {
+			local, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.forwardConn(local)
+		}
+	}()
+	return l, nil
+}
+
+func (d *Driver) forwardConn(local net.Conn) {
+	defer local.Close()
+	port, err := d.BaseDriver.GetSSHPort()
+	if err != nil {
+		return
+	}
+	remote, err := d.dialGuest(port)
+	if err != nil {
+		d.debugf("failed tunneling to %s through jump host: %v", d.IPAddress, err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// parseJumpHost splits [user@]host[:port] into a dialable address and user
+func parseJumpHost(s string) (string, string) {
+	username := ""
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		username, s = s[:i], s[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, "22")
+	}
+	return s, username
+}
@@ -0,0 +1,65 @@
+package driver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestParseJumpHost(t *testing.T) {
+	tests := map[string]struct {
+		addr string
+		user string
+	}{
+		"bastion":                {addr: "bastion:22"},
+		"ops@bastion":            {addr: "bastion:22", user: "ops"},
+		"ops@bastion:2222":       {addr: "bastion:2222", user: "ops"},
+		"[2001:db8::1]:2222":     {addr: "[2001:db8::1]:2222"},
+		"ops@10.0.0.1":           {addr: "10.0.0.1:22", user: "ops"},
+		"ops@corp@bastion:22022": {addr: "bastion:22022", user: "ops@corp"},
+	}
+	for in, test := range tests {
+		t.Run(in, func(t *testing.T) {
+			addr, user := parseJumpHost(in)
+			assert.Equal(t, test.addr, addr)
+			assert.Equal(t, test.user, user)
+		})
+	}
+}
+
+func TestJumpHostKeyCallback(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other, err := ssh.NewPublicKey(otherPub)
+	require.NoError(t, err)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{"bastion"}, key)+"\n"), 0600))
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	tests := map[string]*Driver{
+		"known hosts": {SSHJumpKnownHosts: knownHosts},
+		"fingerprint": {SSHJumpFingerprint: strings.TrimPrefix(ssh.FingerprintSHA256(key), "SHA256:")},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			callback, err := d.jumpHostKeyCallback()
+			require.NoError(t, err)
+			assert.NoError(t, callback("bastion:22", remote, key))
+			assert.Error(t, callback("bastion:22", remote, other))
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LoadMachine reads a machine's driver from the docker-machine store so it can
+// be operated on outside of docker-machine
+func LoadMachine(storePath, name string) (*Driver, error) {
+	buf, err := os.ReadFile(filepath.Join(storePath, "machines", name, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	host := struct {
+		DriverName string
+		Driver     *Driver
+	}{
+		Driver: NewDriver(name, storePath).(*Driver),
+	}
+	err = json.Unmarshal(buf, &host)
+	if err != nil {
+		return nil, err
+	}
+	if host.DriverName != host.Driver.DriverName() {
+		return nil, fmt.Errorf("machine %s uses driver '%s' not '%s'", name, host.DriverName, host.Driver.DriverName())
+	}
+	return host.Driver, nil
+}
+
+// SaveMachine writes the driver back into the machine's docker-machine config
+func (d *Driver) SaveMachine() error {
+	path := d.ResolveStorePath("config.json")
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	host := map[string]json.RawMessage{}
+	err = json.Unmarshal(buf, &host)
+	if err != nil {
+		return err
+	}
+	host["Driver"], err = json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	buf, err = json.MarshalIndent(host, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf, 0600)
+}
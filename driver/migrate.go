@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster/ha/resources"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
+)
+
+// Migrate live migrates the VM to target, or to the best available node when
+// target is empty, and records the new node
+func (d *Driver) Migrate(target string, withLocalDisks bool) error {
+	if d.VMID < 1 {
+		return fmt.Errorf("invalid VMID")
+	}
+
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	// make sure we migrate from where the VM is now
+	err = d.locateVM()
+	if err != nil {
+		return err
+	}
+
+	if target == "" {
+		current := d.Node
+		d.Node = ""
+		target, err = d.findAvailableNode(context.Background(), current)
+		d.Node = current
+		if err != nil {
+			return err
+		}
+	}
+	if target == d.Node {
+		d.debugf("vm %d already on %s", d.VMID, target)
+		return nil
+	}
+
+	if d.HAEnabled {
+		return d.migrateHA(target)
+	}
+
+	d.debugf("migrating vm %d from %s to %s", d.VMID, d.Node, target)
+	taskID, err := qemu.New(c).MigrateVm(context.Background(), qemu.MigrateVmRequest{
+		Node:           d.Node,
+		Target:         target,
+		Vmid:           d.VMID,
+		Online:         proxmox.PVEBool(true),
+		WithLocalDisks: proxmox.PVEBool(withLocalDisks),
+	})
+	if err != nil {
+		return err
+	}
+	err = d.waitForTaskToComplete(context.Background(), taskID, 30*time.Minute)
+	if err != nil {
+		return err
+	}
+	d.Node = target
+	return nil
+}
+
+// migrateHA asks the HA manager to migrate the VM, migrating directly would be
+// undone by HA
+func (d *Driver) migrateHA(target string) error {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	d.debugf("requesting HA migration of %s to %s", d.haSid(), target)
+	err = resources.New(c).Migrate(context.Background(), resources.MigrateRequest{
+		Sid:  d.haSid(),
+		Node: target,
+	})
+	if err != nil {
+		return err
+	}
+
+	endTime := time.Now().Add(30 * time.Minute)
+	for !time.Now().After(endTime) {
+		err = d.locateVM()
+		if err != nil {
+			return err
+		}
+		if d.Node == target {
+			return nil
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return fmt.Errorf("timed out waiting for HA migration to %s", target)
+}
@@ -0,0 +1,53 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateToAvailableNode(t *testing.T) {
+	gig := 1024 * 1024 * 1024
+	migrated := false
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/cluster/resources":
+			fmt.Fprint(w, `{"data":[{"id":"qemu/100","type":"qemu","vmid":100,"node":"pve1"}]}`)
+		case r.URL.Path == "/nodes/pve1/qemu/100/migrate":
+			body, _ := io.ReadAll(r.Body)
+			form, err := url.ParseQuery(string(body))
+			assert.NoError(t, err)
+			assert.Equal(t, "pve3", form.Get("target"))
+			assert.Equal(t, "1", form.Get("online"))
+			migrated = true
+			fmt.Fprint(w, `{"data":"UPID:pve1:1"}`)
+		case strings.HasPrefix(r.URL.Path, "/nodes/pve1/tasks/"):
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		case strings.HasSuffix(r.URL.Path, "/qemu") || strings.HasSuffix(r.URL.Path, "/lxc"):
+			fmt.Fprint(w, `{"data":[]}`)
+		case r.URL.Path == "/nodes":
+			fmt.Fprintf(w, `{"data":[{"node":"pve1","maxmem":%d,"maxcpu":8,"status":"online"},{"node":"pve2","maxmem":%d,"maxcpu":8,"status":"online"},{"node":"pve3","maxmem":%d,"maxcpu":8,"status":"online"}]}`, 64*gig, 16*gig, 32*gig)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		Node:     "pve1",
+		AnyNode:  true,
+		VMID:     100,
+		Memory:   1024,
+		CPUCores: 1,
+		client:   proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.Migrate("", false))
+	assert.True(t, migrated)
+	assert.Equal(t, "pve3", d.Node)
+}
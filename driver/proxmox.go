@@ -3,11 +3,16 @@ package driver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/FreekingDean/proxmox-api-go/proxmox"
 	"github.com/FreekingDean/proxmox-api-go/proxmox/access"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
 	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu/agent"
 	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/tasks"
 )
@@ -18,22 +23,135 @@ func (d *Driver) EnsureClient() (*proxmox.Client, error) {
 	}
 	d.debugf("Create called")
 
-	d.debugf("Connecting to %s as %s@%s with password '%s'", d.Host, d.User, d.Realm, d.Password)
 	client := proxmox.NewClient(d.Host)
+	err := d.login(context.Background(), client)
+	if err != nil {
+		return nil, err
+	}
+	d.client = client
+	return client, nil
+}
+
+// login requests a ticket for client, also renewing an expired one
+func (d *Driver) login(ctx context.Context, client *proxmox.Client) error {
+	d.debugf("Connecting to %s as %s@%s with password '%s'", d.Host, d.User, d.Realm, d.Password)
 	a := access.New(client)
-	ticket, err := a.CreateTicket(context.Background(), access.CreateTicketRequest{
+	ticket, err := a.CreateTicket(ctx, access.CreateTicketRequest{
 		Username: d.User,
 		Password: d.Password,
 		Realm:    &d.Realm,
 	})
 	if err != nil {
 		d.debugf("error retreiving ticket %s", err.Error())
-		return nil, err
+		return err
 	}
 	client.SetCookie(*ticket.Ticket)
 	client.SetCsrf(*ticket.Csrfpreventiontoken)
-	d.client = client
-	return client, nil
+	return nil
+}
+
+// isVMMissing reports whether err is Proxmox VE stating the VM is not on the
+// node it was requested from, which happens after HA failover or migration
+func isVMMissing(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "does not exist")
+}
+
+// locateVM looks up the node currently hosting the VM and stores it in Node
+func (d *Driver) locateVM() error {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	d.debugf("locating vm %d", d.VMID)
+	resources, err := cluster.New(c).Resources(context.Background(), cluster.ResourcesRequest{
+		Type: cluster.PtrType(cluster.Type_VM),
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range resources {
+		if r.Vmid == nil || *r.Vmid != d.VMID || r.Node == nil {
+			continue
+		}
+		if *r.Node != d.Node {
+			d.debugf("vm %d moved from %s to %s", d.VMID, d.Node, *r.Node)
+			d.Node = *r.Node
+		}
+		return nil
+	}
+	return fmt.Errorf("vm %d not found in cluster", d.VMID)
+}
+
+// withVMNode runs f and, if the VM is no longer on Node, locates it and
+// runs f again against the VM's current node
+func (d *Driver) withVMNode(f func() error) error {
+	err := f()
+	if !isVMMissing(err) {
+		return err
+	}
+	lerr := d.locateVM()
+	if lerr != nil {
+		return fmt.Errorf("%w (locating vm: %v)", err, lerr)
+	}
+	return f()
+}
+
+// verifyVM checks that VMID still refers to this machine's VM, so a stale
+// VMID reused by another VM is never acted upon
+func (d *Driver) verifyVM(ctx context.Context) error {
+	cfg, err := d.vmConfig(ctx)
+	if err != nil {
+		return err
+	}
+	return d.verifyConfig(cfg)
+}
+
+func (d *Driver) vmConfig(ctx context.Context) (qemu.VmConfigResponse, error) {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return qemu.VmConfigResponse{}, err
+	}
+
+	var cfg qemu.VmConfigResponse
+	err = d.withVMNode(func() error {
+		cfg, err = qemu.New(c).VmConfig(ctx, qemu.VmConfigRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+		})
+		return err
+	})
+	return cfg, err
+}
+
+// verifyConfig checks the VM's name and, for machines created since VMs are
+// tagged, its driver and machine ID tags
+func (d *Driver) verifyConfig(cfg qemu.VmConfigResponse) error {
+	name := ""
+	if cfg.Name != nil {
+		name = *cfg.Name
+	}
+	if name != d.vmName() {
+		return fmt.Errorf("vm %d is named '%s', not '%s'", d.VMID, name, d.vmName())
+	}
+	if d.MachineID == "" {
+		return nil
+	}
+	for _, tag := range []string{driverTag, d.machineIDTag()} {
+		if cfg.Tags == nil || !hasTag(*cfg.Tags, tag) {
+			return fmt.Errorf("vm %d is not tagged %s", d.VMID, tag)
+		}
+	}
+	return nil
+}
+
+// vmName returns the name of the machine's VM, which differs from the machine
+// name for adopted VMs
+func (d *Driver) vmName() string {
+	if d.VMName != "" {
+		return d.VMName
+	}
+	return d.GetMachineName()
 }
 
 type AgentResponse struct {
@@ -46,7 +164,7 @@ type AgentResponse struct {
 	} `json:"result"`
 }
 
-func (d *Driver) getVMIp() (string, error) {
+func (d *Driver) getVMIp(ctx context.Context) (string, error) {
 	d.debugf("checking for IP address")
 	c, err := d.EnsureClient()
 	if err != nil {
@@ -54,27 +172,31 @@ func (d *Driver) getVMIp() (string, error) {
 	}
 
 	a := agent.New(c)
-	resp, err := a.Create(context.Background(), agent.CreateRequest{
-		Command: "network-get-interfaces",
-		Node:    d.Node,
-		Vmid:    d.VMID,
+	var resp map[string]interface{}
+	err = d.withVMNode(func() error {
+		resp, err = a.Create(ctx, agent.CreateRequest{
+			Command: "network-get-interfaces",
+			Node:    d.Node,
+			Vmid:    d.VMID,
+		})
+		return err
 	})
 	if err != nil {
-		d.debugf("error getting agent: %w", err)
-		return "", nil
+		d.debugf("error getting agent: %v", err)
+		return "", err
 	}
 
 	jsonStr, err := json.Marshal(resp)
 	d.debugf("agent-resp: %s", jsonStr)
 	if err != nil {
-		d.debugf("Error marshalling json: %w", err)
+		d.debugf("Error marshalling json: %v", err)
 		return "", nil
 	}
 
 	data := &AgentResponse{}
 	err = json.Unmarshal(jsonStr, data)
 	if err != nil {
-		d.debugf("Error unmarshalling json: %w", err)
+		d.debugf("Error unmarshalling json: %v", err)
 		return "", nil
 	}
 
@@ -90,7 +212,10 @@ func (d *Driver) getVMIp() (string, error) {
 	return "", nil
 }
 
-func (d *Driver) waitForTaskToComplete(taskId string, dur time.Duration) error {
+// waitForTaskToComplete polls the task until it finishes, for at most dur or
+// TaskTimeout when set. Should ctx end first the task is stopped, so a
+// cancelled operation does not leave it running.
+func (d *Driver) waitForTaskToComplete(ctx context.Context, taskId string, dur time.Duration) error {
 	c, err := d.EnsureClient()
 	if err != nil {
 		return err
@@ -98,26 +223,122 @@ func (d *Driver) waitForTaskToComplete(taskId string, dur time.Duration) error {
 
 	t := tasks.New(c)
 
-	endTime := time.Now().Add(dur)
-	for !time.Now().After(endTime) {
-		resp, err := t.ReadTaskStatus(
-			context.Background(),
-			tasks.ReadTaskStatusRequest{
-				Node: d.Node,
-				Upid: taskId,
-			},
-		)
+	if d.TaskTimeout > 0 {
+		dur = time.Duration(d.TaskTimeout) * time.Second
+	}
+	tctx, cancel := context.WithTimeout(ctx, dur)
+	defer cancel()
+	for tctx.Err() == nil {
+		var resp tasks.ReadTaskStatusResponse
+		err = d.retry(tctx, defaultBackoff, func() error {
+			resp, err = t.ReadTaskStatus(
+				tctx,
+				tasks.ReadTaskStatusRequest{
+					Node: d.Node,
+					Upid: taskId,
+				},
+			)
+			return err
+		})
 		if err != nil {
+			if tctx.Err() != nil {
+				break
+			}
 			return err
 		}
 		if resp.Status != "running" {
 			if resp.Exitstatus != nil && *resp.Exitstatus != "OK" {
-				return fmt.Errorf("task failed '%v'", resp.Exitstatus)
+				return d.taskError(ctx, t, taskId, *resp.Exitstatus)
 			}
 			return nil
 		}
-		time.Sleep(500 * time.Millisecond)
+		sleep(tctx, 500*time.Millisecond)
 	}
 
+	if ctx.Err() != nil {
+		d.debugf("stopping task %s", taskId)
+		err := t.Delete(context.Background(), tasks.DeleteRequest{
+			Node: d.Node,
+			Upid: taskId,
+		})
+		if err != nil {
+			d.debugf("error stopping task: %v", err)
+		}
+		return fmt.Errorf("gave up waiting for task: %w", ctx.Err())
+	}
 	return fmt.Errorf("timed out waiting for task")
 }
+
+// taskLogTail is how many of the last task log lines a task error includes
+const taskLogTail = 10
+
+// taskError describes a failed task with the tail of its log, saving the full
+// log in the machine store for later inspection
+func (d *Driver) taskError(ctx context.Context, t *tasks.Client, taskId, status string) error {
+	lines, err := d.readTaskLog(ctx, t, taskId)
+	if err != nil {
+		d.debugf("error reading task log: %v", err)
+		return fmt.Errorf("task failed '%s'", status)
+	}
+
+	msg := fmt.Sprintf("task failed '%s'", status)
+	tail := lines
+	if len(tail) > taskLogTail {
+		tail = tail[len(tail)-taskLogTail:]
+	}
+	if len(tail) > 0 {
+		msg += ":\n" + strings.Join(tail, "\n")
+	}
+	if path, err := d.saveTaskLog(taskId, lines); err != nil {
+		d.debugf("error saving task log: %v", err)
+	} else if path != "" {
+		msg += "\nfull task log: " + path
+	}
+	return errors.New(msg)
+}
+
+func (d *Driver) readTaskLog(ctx context.Context, t *tasks.Client, taskId string) ([]string, error) {
+	const page = 500
+	lines := []string{}
+	for {
+		resp, err := t.ReadTaskLog(ctx, tasks.ReadTaskLogRequest{
+			Node:  d.Node,
+			Upid:  taskId,
+			Start: proxmox.Int(len(lines)),
+			Limit: proxmox.Int(page),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range resp {
+			// the log ends with a line such as "TASK ERROR: ..." and, past
+			// the end, a single "no content" line
+			if l.T == "no content" && len(resp) == 1 {
+				return lines, nil
+			}
+			lines = append(lines, l.T)
+		}
+		if len(resp) < page {
+			return lines, nil
+		}
+	}
+}
+
+// saveTaskLog writes the task log into the machine store, returning its path
+func (d *Driver) saveTaskLog(taskId string, lines []string) (string, error) {
+	if d.BaseDriver == nil || d.StorePath == "" {
+		return "", nil
+	}
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.Trim(taskId, ":"))
+	path := d.ResolveStorePath("task-" + name + ".log")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -1,13 +1,18 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/FreekingDean/proxmox-api-go/proxmox"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetVMIp(t *testing.T) {
@@ -18,11 +23,75 @@ func TestGetVMIp(t *testing.T) {
 		driverDebug: true,
 		client:      proxmox.NewClient(s.URL),
 	}
-	resp, err := d.getVMIp()
+	resp, err := d.getVMIp(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, "10.0.0.1", resp)
 }
 
+func TestWaitForTaskCancelled(t *testing.T) {
+	stopped := false
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:create/status":
+			fmt.Fprint(w, `{"data":{"status":"running"}}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:create":
+			stopped = true
+			fmt.Fprint(w, `{"data":null}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		Node:   "pve1",
+		client: proxmox.NewClient(s.URL),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := d.waitForTaskToComplete(ctx, "UPID:pve1:create", time.Minute)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, stopped)
+
+	// running out of the task's own time leaves it running
+	stopped = false
+	err = d.waitForTaskToComplete(context.Background(), "UPID:pve1:create", time.Second)
+	assert.Error(t, err)
+	assert.False(t, stopped)
+}
+
+func TestWaitForTaskFailed(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nodes/pve1/tasks/UPID:pve1:create/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"import failed"}}`)
+		case "/nodes/pve1/tasks/UPID:pve1:create/log":
+			lines := []string{}
+			for i := 1; i <= 12; i++ {
+				lines = append(lines, fmt.Sprintf(`{"n":%d,"t":"line %d"}`, i, i))
+			}
+			fmt.Fprintf(w, `{"data":[%s]}`, strings.Join(lines, ","))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := newKeyTestDriver(t)
+	d.Node = "pve1"
+	d.client = proxmox.NewClient(s.URL)
+
+	err := d.waitForTaskToComplete(context.Background(), "UPID:pve1:create", time.Minute)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "task failed 'import failed'")
+	assert.Contains(t, err.Error(), "line 3\nline 4")
+	assert.NotContains(t, err.Error(), "line 2\n")
+	assert.Contains(t, err.Error(), "line 12")
+
+	buf, err := os.ReadFile(d.ResolveStorePath("task-UPID_pve1_create.log"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf), "line 1\nline 2\n"))
+}
+
 const mockresp = `
 { "data":{
   "result": [
@@ -0,0 +1,203 @@
+package driver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
+	"github.com/docker/machine/libmachine/drivers"
+)
+
+const (
+	// driverTag marks every VM created by the driver
+	driverTag = "docker-machine"
+	// machineIDTagPrefix prefixes the tag holding the VM's machine ID
+	machineIDTagPrefix = "dm-id-"
+)
+
+func newMachineID() (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (d *Driver) machineIDTag() string {
+	return machineIDTagPrefix + d.MachineID
+}
+
+// Orphan is a VM created by the driver that no machine in the docker-machine
+// store accounts for
+type Orphan struct {
+	VMID      int
+	Node      string
+	Name      string
+	MachineID string
+}
+
+// FindOrphans lists the driver's VMs in Pool, or the whole cluster if Pool is
+// unset, whose machine is not in the docker-machine store at storePath.
+// Machines still being created are recognised by their create checkpoint.
+func (d *Driver) FindOrphans(storePath string) ([]Orphan, error) {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return nil, err
+	}
+
+	knownIDs, knownVMIDs, err := storeMachines(storePath)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := cluster.New(c).Resources(context.Background(), cluster.ResourcesRequest{
+		Type: cluster.PtrType(cluster.Type_VM),
+	})
+	if err != nil {
+		return nil, err
+	}
+	nodeSet := map[string]bool{}
+	inPool := map[int]bool{}
+	for _, r := range resources {
+		if r.Type != cluster.Type_QEMU || r.Vmid == nil || r.Node == nil {
+			continue
+		}
+		if d.Pool != "" && (r.Pool == nil || *r.Pool != d.Pool) {
+			continue
+		}
+		nodeSet[*r.Node] = true
+		inPool[*r.Vmid] = true
+	}
+	nodeNames := []string{}
+	for node := range nodeSet {
+		nodeNames = append(nodeNames, node)
+	}
+	sort.Strings(nodeNames)
+
+	orphans := []Orphan{}
+	for _, node := range nodeNames {
+		d.debugf("loading vms for %s", node)
+		vms, err := qemu.New(c).Index(context.Background(), qemu.IndexRequest{
+			Node: node,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, vm := range vms {
+			if !inPool[vm.Vmid] || vm.Tags == nil || !hasTag(*vm.Tags, driverTag) {
+				continue
+			}
+			machineID := tagMachineID(*vm.Tags)
+			if knownIDs[machineID] || knownVMIDs[vm.Vmid] {
+				continue
+			}
+			o := Orphan{VMID: vm.Vmid, Node: node, MachineID: machineID}
+			if vm.Name != nil {
+				o.Name = *vm.Name
+			}
+			orphans = append(orphans, o)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].VMID < orphans[j].VMID })
+	return orphans, nil
+}
+
+// RemoveOrphan deletes an orphaned VM found by FindOrphans
+func (d *Driver) RemoveOrphan(o Orphan) error {
+	orphan := &Driver{
+		BaseDriver: &drivers.BaseDriver{
+			MachineName: o.Name,
+			StorePath:   d.StorePath,
+		},
+		client:      d.client,
+		Host:        d.Host,
+		User:        d.User,
+		Password:    d.Password,
+		Realm:       d.Realm,
+		Node:        o.Node,
+		VMID:        o.VMID,
+		MachineID:   o.MachineID,
+		HAEnabled:   true, // not knowing better, drop any HA resource
+		driverDebug: d.driverDebug,
+	}
+	return orphan.Remove()
+}
+
+// tagMachineID returns the machine ID held in a Proxmox VE tag list
+func tagMachineID(tags string) string {
+	for _, t := range strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	}) {
+		if strings.HasPrefix(t, machineIDTagPrefix) {
+			return strings.TrimPrefix(t, machineIDTagPrefix)
+		}
+	}
+	return ""
+}
+
+// storeMachines returns the machine IDs and VMIDs of the machines in the
+// docker-machine store, including ones still being created. A machine that
+// cannot be read is an error, as its VM would otherwise look orphaned.
+func storeMachines(storePath string) (map[string]bool, map[int]bool, error) {
+	ids := map[string]bool{}
+	vmids := map[int]bool{}
+	entries, err := os.ReadDir(filepath.Join(storePath, "machines"))
+	if os.IsNotExist(err) {
+		return ids, vmids, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(storePath, "machines", e.Name())
+		buf, err := os.ReadFile(filepath.Join(dir, "config.json"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("could not read machine %s: %w", e.Name(), err)
+		}
+		if err == nil {
+			host := struct{ DriverName string }{}
+			err = json.Unmarshal(buf, &host)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not read machine %s: %w", e.Name(), err)
+			}
+			if host.DriverName == (&Driver{}).DriverName() {
+				m, err := LoadMachine(storePath, e.Name())
+				if err != nil {
+					return nil, nil, fmt.Errorf("could not read machine %s: %w", e.Name(), err)
+				}
+				ids[m.MachineID] = true
+				vmids[m.VMID] = true
+			}
+		}
+
+		buf, err = os.ReadFile(filepath.Join(dir, checkpointFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read machine %s: %w", e.Name(), err)
+		}
+		cp := createCheckpoint{}
+		err = json.Unmarshal(buf, &cp)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read create checkpoint of machine %s: %w", e.Name(), err)
+		}
+		ids[cp.MachineID] = true
+		vmids[cp.VMID] = true
+	}
+	// machines from before machine IDs are never orphans
+	delete(ids, "")
+	return ids, vmids, nil
+}
@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindOrphans(t *testing.T) {
+	store := t.TempDir()
+	writeStoreFile := func(machine, file, content string) {
+		dir := filepath.Join(store, "machines", machine)
+		require.NoError(t, os.MkdirAll(dir, 0700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, file), []byte(content), 0600))
+	}
+	writeStoreFile("known", "config.json", `{"DriverName":"proxmoxve","Driver":{"MachineID":"aaaa","VMID":101}}`)
+	writeStoreFile("creating", checkpointFile, `{"VMID":103,"MachineID":"cccc"}`)
+	writeStoreFile("other", "config.json", `{"DriverName":"virtualbox","Driver":{}}`)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cluster/resources":
+			fmt.Fprint(w, `{"data":[
+				{"id":"qemu/101","type":"qemu","vmid":101,"node":"pve1","pool":"docker"},
+				{"id":"qemu/102","type":"qemu","vmid":102,"node":"pve1","pool":"docker"},
+				{"id":"qemu/103","type":"qemu","vmid":103,"node":"pve1","pool":"docker"},
+				{"id":"qemu/104","type":"qemu","vmid":104,"node":"pve1","pool":"other"},
+				{"id":"qemu/105","type":"qemu","vmid":105,"node":"pve1","pool":"docker"},
+				{"id":"lxc/106","type":"lxc","vmid":106,"node":"pve1","pool":"docker"}
+			]}`)
+		case "/nodes/pve1/qemu":
+			fmt.Fprint(w, `{"data":[
+				{"vmid":101,"name":"known","status":"running","tags":"docker-machine;dm-id-aaaa"},
+				{"vmid":102,"name":"failed","status":"stopped","tags":"docker-machine;dm-id-bbbb;rancher"},
+				{"vmid":103,"name":"creating","status":"stopped","tags":"docker-machine;dm-id-cccc"},
+				{"vmid":104,"name":"elsewhere","status":"stopped","tags":"docker-machine;dm-id-dddd"},
+				{"vmid":105,"name":"handmade","status":"running"}
+			]}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		Pool:   "docker",
+		client: proxmox.NewClient(s.URL),
+	}
+
+	orphans, err := d.FindOrphans(store)
+	require.NoError(t, err)
+	assert.Equal(t, []Orphan{{VMID: 102, Node: "pve1", Name: "failed", MachineID: "bbbb"}}, orphans)
+}
+
+func TestStoreMachines(t *testing.T) {
+	tests := map[string]struct {
+		file    string
+		content string
+		err     bool
+	}{
+		"other driver":       {file: "config.json", content: `{"DriverName":"virtualbox","Driver":{"VMID":"x"}}`},
+		"no config":          {file: "id_ed25519", content: "key"},
+		"truncated config":   {file: "config.json", content: `{"DriverName":"proxmoxve","Dri`, err: true},
+		"unreadable driver":  {file: "config.json", content: `{"DriverName":"proxmoxve","Driver":{"VMID":"x"}}`, err: true},
+		"corrupt checkpoint": {file: checkpointFile, content: `{"VMID":`, err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := t.TempDir()
+			dir := filepath.Join(store, "machines", "m")
+			require.NoError(t, os.MkdirAll(dir, 0700))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, test.file), []byte(test.content), 0600))
+
+			_, _, err := storeMachines(store)
+			if test.err {
+				assert.ErrorContains(t, err, "machine m")
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster/ha/resources"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu/status"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/labstack/gommon/log"
+)
+
+// Remove removes the VM
+func (d *Driver) Remove() error {
+	ctx, stop := signalContext()
+	defer stop()
+	return d.remove(ctx)
+}
+
+// remove deletes the VM, but only once it is verified to still be this
+// machine's VM and is not protected in Proxmox VE
+func (d *Driver) remove(ctx context.Context) error {
+	if d.VMID < 1 {
+		return d.removeCheckpointed(ctx)
+	}
+
+	cfg, err := d.vmConfig(ctx)
+	if isVMMissing(err) {
+		log.Warnf("VM %d no longer exists, nothing to remove", d.VMID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = d.verifyConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("refusing to remove: %w", err)
+	}
+	if cfg.Protection != nil && bool(*cfg.Protection) {
+		return fmt.Errorf("vm %d is protected, turn off its protection in Proxmox VE to remove it", d.VMID)
+	}
+
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+	q := qemu.New(c)
+
+	// check before stopping anything that the data disks can be kept
+	var detach, owned []string
+	var targets map[string]string
+	if d.KeepDataDisks {
+		var pending []qemu.VmPendingResponse
+		err = d.withVMNode(func() error {
+			pending, err = q.VmPending(ctx, qemu.VmPendingRequest{
+				Node: d.Node,
+				Vmid: d.VMID,
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		detach, owned = dataDisks(pending, d.VMID)
+		if len(owned) > 0 {
+			targets, err = d.keeperTargets(ctx, owned)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// HA would restart the VM, remove it from HA before shutting down
+	if d.HAEnabled {
+		err := d.unregisterHA(ctx)
+		if err != nil {
+			return fmt.Errorf("could not remove HA resource %s: %w", d.haSid(), err)
+		}
+	}
+
+	// force shut down VM before invoking delete
+	err = d.kill(ctx)
+	if isVMMissing(err) {
+		log.Warnf("VM %d no longer exists, nothing to remove", d.VMID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not stop vm %d: %w", d.VMID, err)
+	}
+
+	// reassigning takes the disks out of the VM, so deleting it keeps them
+	for _, disk := range owned {
+		d.debugf("moving data disk %s to vm %d as %s", disk, d.KeepDataDisksVMID, targets[disk])
+		target := qemu.TargetDisk(targets[disk])
+		var taskID string
+		err = d.withVMNode(func() error {
+			taskID, err = q.MoveVmDiskMoveDisk(ctx, qemu.MoveVmDiskMoveDiskRequest{
+				Node:       d.Node,
+				Vmid:       d.VMID,
+				Disk:       qemu.Disk(disk),
+				TargetVmid: proxmox.Int(d.KeepDataDisksVMID),
+				TargetDisk: &target,
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not move data disk %s to vm %d: %w", disk, d.KeepDataDisksVMID, err)
+		}
+		err = d.waitForTaskToComplete(ctx, taskID, 10*time.Minute)
+		if err != nil {
+			return fmt.Errorf("could not move data disk %s to vm %d: %w", disk, d.KeepDataDisksVMID, err)
+		}
+	}
+
+	if len(detach) > 0 {
+		d.debugf("detaching data disks %s", strings.Join(detach, ","))
+		err = d.withVMNode(func() error {
+			return q.UpdateVmConfig(ctx, qemu.UpdateVmConfigRequest{
+				Node:   d.Node,
+				Vmid:   d.VMID,
+				Delete: proxmox.String(strings.Join(detach, ",")),
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var taskID string
+	err = d.withVMNode(func() error {
+		taskID, err = q.Delete(ctx, qemu.DeleteRequest{
+			Vmid:                     d.VMID,
+			Node:                     d.Node,
+			DestroyUnreferencedDisks: proxmox.PVEBool(!d.KeepDataDisks),
+			Purge:                    proxmox.PVEBool(true),
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return d.waitForTaskToComplete(ctx, taskID, 10*time.Minute)
+}
+
+// removeCheckpointed removes the VM of a create that died before recording
+// it in the machine store, as found in its create checkpoint
+func (d *Driver) removeCheckpointed(ctx context.Context) error {
+	cp, err := d.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+	if cp.VMID < 1 {
+		return nil
+	}
+	d.VMID, d.Node, d.MachineID = cp.VMID, cp.Node, cp.MachineID
+	cfg, err := d.vmConfig(ctx)
+	if err == nil && d.verifyConfig(cfg) != nil {
+		// the create never got this VMID, a concurrent create took it
+		log.Warnf("VM %d was not created by this machine, nothing to remove", d.VMID)
+		cp.clear()
+		return nil
+	}
+	err = d.remove(ctx)
+	if err != nil {
+		return err
+	}
+	cp.clear()
+	return nil
+}
+
+// discardStopTimeout and discardDeleteTimeout bound the cleanup of an
+// interrupted create. docker-machine is likely gone, and the plugin exits
+// about ten seconds after it stops hearing from it.
+var (
+	discardStopTimeout   = 5 * time.Second
+	discardDeleteTimeout = 3 * time.Second
+)
+
+// discard makes a single best-effort attempt at deleting the VM of an
+// interrupted create. A VM it leaves behind is recorded in the machine store,
+// for docker-machine rm or reconcile to remove.
+func (d *Driver) discard() {
+	err := func() error {
+		c, err := d.EnsureClient()
+		if err != nil {
+			return err
+		}
+
+		// the create's ctx is done, clean up with fresh ones
+		ctx, cancel := context.WithTimeout(context.Background(), discardStopTimeout)
+		defer cancel()
+		if d.HAEnabled {
+			// no time to wait for the HA manager, the delete purges it anyway
+			err = resources.New(c).Delete(ctx, resources.DeleteRequest{Sid: d.haSid()})
+			if err != nil {
+				d.debugf("error removing HA resource: %v", err)
+			}
+		}
+		// wait for the VM rather than the stop task, which waitForTaskToComplete
+		// would stop once ctx runs out
+		_, err = status.New(c).VmStop(ctx, status.VmStopRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+		})
+		if err == nil {
+			deadline, _ := ctx.Deadline()
+			err = d.waitForState(state.Stopped, time.Until(deadline))
+		}
+		if err != nil {
+			d.debugf("error stopping vm: %v", err)
+		}
+
+		// the delete gets a budget of its own, however long the stop took, and
+		// its task carries on without us
+		ctx, cancel = context.WithTimeout(context.Background(), discardDeleteTimeout)
+		defer cancel()
+		_, err = qemu.New(c).Delete(ctx, qemu.DeleteRequest{
+			Vmid:                     d.VMID,
+			Node:                     d.Node,
+			DestroyUnreferencedDisks: proxmox.PVEBool(true),
+			Purge:                    proxmox.PVEBool(true),
+		})
+		return err
+	}()
+	if err != nil {
+		log.Warnf("Could not remove VM %d of the failed create, remove the machine to retry: %v", d.VMID, err)
+	}
+}
+
+// protect sets the protection flag of the VM, so Proxmox VE refuses to delete
+// it or its disks
+func (d *Driver) protect(ctx context.Context) error {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+	return d.withVMNode(func() error {
+		return qemu.New(c).UpdateVmConfig(ctx, qemu.UpdateVmConfigRequest{
+			Node:       d.Node,
+			Vmid:       d.VMID,
+			Protection: proxmox.PVEBool(true),
+		})
+	})
+}
+
+var (
+	diskKey   = regexp.MustCompile(`^(ide|sata|scsi|virtio)\d+$`)
+	unusedKey = regexp.MustCompile(`^unused\d+$`)
+)
+
+// dataDisks returns the drives of the VM config cfg to detach so deleting the
+// VM keeps them, which are all disks but the boot disk. Proxmox VE destroys
+// the volumes a VM owns along with it, detached or not, so data disks owned
+// by vmid are returned separately as owned: they have to be moved to another
+// VM to be kept.
+func dataDisks(cfg []qemu.VmPendingResponse, vmid int) (detach []string, owned []string) {
+	values := map[string]string{}
+	keys := []string{}
+	for _, opt := range cfg {
+		if opt.Value != nil {
+			values[opt.Key] = *opt.Value
+			keys = append(keys, opt.Key)
+		}
+	}
+	sort.Strings(keys)
+
+	boot := bootDisk(values)
+	for _, key := range keys {
+		unused := unusedKey.MatchString(key)
+		if key == boot || !unused && !diskKey.MatchString(key) {
+			continue
+		}
+		volume, _, _ := strings.Cut(values[key], ",")
+		if volume == "none" || strings.Contains(values[key], "media=cdrom") {
+			continue
+		}
+		if ownsVolume(volume, vmid) {
+			owned = append(owned, key)
+		} else if !unused {
+			detach = append(detach, key)
+		}
+	}
+	return detach, owned
+}
+
+// keeperTargets returns the free config keys of the KeepDataDisksVMID VM to
+// move the owned data disks to. Disks can only be reassigned to a VM on the
+// same node.
+func (d *Driver) keeperTargets(ctx context.Context, owned []string) (map[string]string, error) {
+	if d.KeepDataDisksVMID < 1 {
+		return nil, fmt.Errorf(
+			"data disks %s are owned by vm %d and would be destroyed with it, set %s to move them to another VM",
+			strings.Join(owned, ", "), d.VMID, flagVMKeepDataDisksVMID,
+		)
+	}
+	if d.KeepDataDisksVMID == d.VMID {
+		return nil, fmt.Errorf("cannot keep the data disks of vm %d in itself", d.VMID)
+	}
+	c, err := d.EnsureClient()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := qemu.New(c).VmPending(ctx, qemu.VmPendingRequest{
+		Node: d.Node,
+		Vmid: d.KeepDataDisksVMID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read vm %d on %s to keep the data disks in: %w", d.KeepDataDisksVMID, d.Node, err)
+	}
+	return diskTargets(owned, cfg)
+}
+
+// diskSlots is the number of config keys Proxmox VE has for each kind of disk
+var diskSlots = map[string]int{
+	"ide":    4,
+	"sata":   6,
+	"scsi":   31,
+	"virtio": 16,
+	"unused": 256,
+}
+
+// diskTargets assigns each disk a config key of the same kind that is free in
+// the VM config cfg
+func diskTargets(disks []string, cfg []qemu.VmPendingResponse) (map[string]string, error) {
+	used := map[string]bool{}
+	for _, opt := range cfg {
+		used[opt.Key] = true
+	}
+	targets := map[string]string{}
+	for _, disk := range disks {
+		kind := strings.TrimRight(disk, "0123456789")
+		for i := 0; i < diskSlots[kind]; i++ {
+			key := fmt.Sprintf("%s%d", kind, i)
+			if !used[key] {
+				used[key] = true
+				targets[disk] = key
+				break
+			}
+		}
+		if targets[disk] == "" {
+			return nil, fmt.Errorf("no free %s slot to move data disk %s to", kind, disk)
+		}
+	}
+	return targets, nil
+}
+
+// bootDisk returns the first disk in the boot order of the VM config cfg
+func bootDisk(cfg map[string]string) string {
+	for _, opt := range strings.Split(cfg["boot"], ",") {
+		order, ok := strings.CutPrefix(opt, "order=")
+		if !ok {
+			continue
+		}
+		for _, dev := range strings.Split(order, ";") {
+			if diskKey.MatchString(dev) && !strings.Contains(cfg[dev], "media=cdrom") {
+				return dev
+			}
+		}
+	}
+	if cfg["bootdisk"] != "" {
+		return cfg["bootdisk"]
+	}
+	return "scsi0"
+}
+
+// ownsVolume reports whether the volume ID, such as local-lvm:vm-100-disk-1
+// or local:100/vm-100-disk-0.qcow2, names a volume owned by vmid
+func ownsVolume(volume string, vmid int) bool {
+	if strings.HasPrefix(volume, "/") {
+		return false
+	}
+	name := volume[strings.LastIndexAny(volume, ":/")+1:]
+	return strings.HasPrefix(name, fmt.Sprintf("vm-%d-", vmid)) ||
+		strings.HasPrefix(name, fmt.Sprintf("base-%d-", vmid))
+}
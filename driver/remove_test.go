@@ -0,0 +1,245 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataDisks(t *testing.T) {
+	tests := map[string]struct {
+		cfg    map[string]string
+		detach []string
+		owned  []string
+	}{
+		"boot disk only": {
+			cfg: map[string]string{"scsi0": "local-lvm:vm-100-disk-0,size=32G"},
+		},
+		"shared data disk": {
+			cfg: map[string]string{
+				"boot":  "order=scsi0;net0",
+				"scsi0": "local-lvm:vm-100-disk-0,size=32G",
+				"scsi1": "local-lvm:vm-900-disk-0,size=100G",
+				"ide2":  "local:iso/fedora.iso,media=cdrom",
+			},
+			detach: []string{"scsi1"},
+		},
+		"boot order": {
+			cfg: map[string]string{
+				"boot":    "order=ide2;virtio1",
+				"ide2":    "local:iso/fedora.iso,media=cdrom",
+				"virtio0": "/dev/sdb",
+				"virtio1": "local:100/vm-100-disk-0.qcow2",
+			},
+			detach: []string{"virtio0"},
+		},
+		"owned data disk": {
+			cfg: map[string]string{
+				"scsi0":   "local-lvm:vm-100-disk-0",
+				"scsi1":   "local-lvm:vm-100-disk-1",
+				"unused0": "local-lvm:vm-100-disk-2",
+				"unused1": "local-lvm:vm-900-disk-1",
+			},
+			owned: []string{"scsi1", "unused0"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := []qemu.VmPendingResponse{}
+			for k, v := range tc.cfg {
+				cfg = append(cfg, qemu.VmPendingResponse{Key: k, Value: proxmox.String(v)})
+			}
+			detach, owned := dataDisks(cfg, 100)
+			assert.ElementsMatch(t, tc.detach, detach)
+			assert.Equal(t, tc.owned, owned)
+		})
+	}
+}
+
+func TestDiskTargets(t *testing.T) {
+	cfg := []qemu.VmPendingResponse{
+		{Key: "scsi0", Value: proxmox.String("local-lvm:vm-900-disk-0")},
+		{Key: "scsi1", Value: proxmox.String("local-lvm:vm-900-disk-1")},
+		{Key: "unused0", Value: proxmox.String("local-lvm:vm-900-disk-2")},
+	}
+	targets, err := diskTargets([]string{"scsi1", "scsi3", "unused0"}, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"scsi1": "scsi2", "scsi3": "scsi3", "unused0": "unused1"}, targets)
+
+	full := []qemu.VmPendingResponse{}
+	for i := 0; i < 4; i++ {
+		full = append(full, qemu.VmPendingResponse{Key: fmt.Sprintf("ide%d", i)})
+	}
+	_, err = diskTargets([]string{"ide1"}, full)
+	assert.ErrorContains(t, err, "no free ide slot")
+}
+
+func TestRemoveRefuses(t *testing.T) {
+	tests := map[string]struct {
+		config string
+		err    string
+	}{
+		"renamed":   {config: `{"name":"other","tags":"docker-machine;dm-id-abc"}`, err: "named 'other'"},
+		"untagged":  {config: `{"name":"test","tags":"dm-id-abc"}`, err: "not tagged docker-machine"},
+		"reused":    {config: `{"name":"test","tags":"docker-machine;dm-id-def"}`, err: "not tagged dm-id-abc"},
+		"protected": {config: `{"name":"test","tags":"docker-machine;dm-id-abc","protection":1}`, err: "vm 100 is protected"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/config" {
+					fmt.Fprintf(w, `{"data":%s}`, tc.config)
+					return
+				}
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}))
+			defer s.Close()
+			d := &Driver{
+				BaseDriver: &drivers.BaseDriver{MachineName: "test"},
+				Node:       "pve1",
+				VMID:       100,
+				MachineID:  "abc",
+				client:     proxmox.NewClient(s.URL),
+			}
+			assert.ErrorContains(t, d.remove(context.Background()), tc.err)
+		})
+	}
+}
+
+func TestRemoveKeepDataDisks(t *testing.T) {
+	var detached, destroy string
+	moved := url.Values{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/config":
+			fmt.Fprint(w, `{"data":{"name":"test","tags":"docker-machine;dm-id-abc"}}`)
+		case r.URL.Path == "/nodes/pve1/qemu/100/pending":
+			fmt.Fprint(w, `{"data":[{"key":"scsi0","value":"local-lvm:vm-100-disk-0"},{"key":"scsi1","value":"nfs:900/vm-900-disk-0.qcow2"},{"key":"scsi2","value":"local-lvm:vm-100-disk-1"}]}`)
+		case r.URL.Path == "/nodes/pve1/qemu/900/pending":
+			fmt.Fprint(w, `{"data":[{"key":"scsi0","value":"nfs:900/vm-900-disk-0.qcow2"},{"key":"scsi1","value":"local-lvm:vm-900-disk-1"}]}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/nodes/pve1/qemu/100/move_disk":
+			body, _ := io.ReadAll(r.Body)
+			moved, _ = url.ParseQuery(string(body))
+			fmt.Fprint(w, `{"data":"UPID:pve1:move"}`)
+		case r.URL.Path == "/nodes/pve1/qemu/100/status/stop":
+			fmt.Fprint(w, `{"data":"UPID:pve1:stop"}`)
+		case r.Method == http.MethodPut && r.URL.Path == "/nodes/pve1/qemu/100/config":
+			body, _ := io.ReadAll(r.Body)
+			v, _ := url.ParseQuery(string(body))
+			detached = v.Get("delete")
+			fmt.Fprint(w, `{"data":null}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/nodes/pve1/qemu/100":
+			destroy = r.URL.Query().Get("destroy-unreferenced-disks")
+			fmt.Fprint(w, `{"data":"UPID:pve1:delete"}`)
+		case r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:stop/status",
+			r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:move/status",
+			r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:delete/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		BaseDriver:        &drivers.BaseDriver{MachineName: "test"},
+		Node:              "pve1",
+		VMID:              100,
+		MachineID:         "abc",
+		KeepDataDisks:     true,
+		KeepDataDisksVMID: 900,
+		client:            proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.remove(context.Background()))
+	assert.Equal(t, "scsi2", moved.Get("disk"))
+	assert.Equal(t, "900", moved.Get("target-vmid"))
+	assert.Equal(t, "scsi2", moved.Get("target-disk"))
+	assert.Equal(t, "scsi1", detached)
+	assert.Equal(t, "0", destroy)
+
+	d.KeepDataDisksVMID = 0
+	assert.ErrorContains(t, d.remove(context.Background()), "data disks scsi2 are owned by vm 100")
+}
+
+func TestRemoveStopFails(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/config":
+			fmt.Fprint(w, `{"data":{"name":"test","tags":"docker-machine;dm-id-abc"}}`)
+		case r.URL.Path == "/nodes/pve1/qemu/100/status/stop":
+			writePVEError(t, w, 500, "VM is locked (backup)")
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		BaseDriver: &drivers.BaseDriver{MachineName: "test"},
+		Node:       "pve1",
+		VMID:       100,
+		MachineID:  "abc",
+		client:     proxmox.NewClient(s.URL),
+	}
+	assert.ErrorContains(t, d.remove(context.Background()), "could not stop vm 100")
+}
+
+func TestDiscard(t *testing.T) {
+	defer func(timeout time.Duration) { discardStopTimeout = timeout }(discardStopTimeout)
+	discardStopTimeout = 1500 * time.Millisecond
+
+	tests := map[string]struct {
+		status string
+	}{
+		"stops":        {status: "stopped"},
+		"slow to stop": {status: "running"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			requests := []string{}
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// polls of the VM status are recorded once
+				req := r.Method + " " + r.URL.Path
+				if n := len(requests); n == 0 || requests[n-1] != req {
+					requests = append(requests, req)
+				}
+				switch {
+				case r.Method == http.MethodDelete && r.URL.Path == "/cluster/ha/resources/vm:100":
+					fmt.Fprint(w, `{"data":null}`)
+				case r.URL.Path == "/nodes/pve1/qemu/100/status/stop":
+					fmt.Fprint(w, `{"data":"UPID:pve1:stop"}`)
+				case r.URL.Path == "/nodes/pve1/qemu/100/status/current":
+					fmt.Fprintf(w, `{"data":{"status":%q}}`, test.status)
+				case r.Method == http.MethodDelete && r.URL.Path == "/nodes/pve1/qemu/100":
+					assert.Equal(t, "1", r.URL.Query().Get("purge"))
+					fmt.Fprint(w, `{"data":"UPID:pve1:delete"}`)
+				default:
+					// in particular the stop task is never stopped
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer s.Close()
+			d := &Driver{
+				Node:      "pve1",
+				VMID:      100,
+				HAEnabled: true,
+				client:    proxmox.NewClient(s.URL),
+			}
+			d.discard()
+			assert.Equal(t, []string{
+				"DELETE /cluster/ha/resources/vm:100",
+				"POST /nodes/pve1/qemu/100/status/stop",
+				"GET /nodes/pve1/qemu/100/status/current",
+				"DELETE /nodes/pve1/qemu/100",
+			}, requests)
+		})
+	}
+}
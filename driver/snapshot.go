@@ -0,0 +1,228 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu/agent"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu/snapshot"
+)
+
+// snapshots taken automatically by the driver are prefixed so retention never
+// touches snapshots taken by hand
+const autoSnapshotPrefix = "dm-auto-"
+
+var errFreezeWithRAM = errors.New("cannot freeze guest filesystems for a snapshot including RAM")
+
+// CreateSnapshot snapshots the VM, optionally including RAM. freezeFS requires
+// the guest agent, through which Proxmox VE freezes the guest filesystems for
+// disk-only snapshots; a RAM snapshot of a frozen guest would resume frozen on
+// rollback, so the two exclude each other.
+func (d *Driver) CreateSnapshot(name, description string, withRAM, freezeFS bool) error {
+	if d.VMID < 1 {
+		return errors.New("invalid VMID")
+	}
+
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	if freezeFS {
+		if withRAM {
+			return errFreezeWithRAM
+		}
+		err = d.checkAgent()
+		if err != nil {
+			return err
+		}
+	}
+
+	req := snapshot.CreateRequest{
+		Snapname: name,
+		Vmid:     d.VMID,
+		Vmstate:  proxmox.PVEBool(withRAM),
+	}
+	if description != "" {
+		req.Description = proxmox.String(description)
+	}
+	d.debugf("creating snapshot %s", name)
+	s := snapshot.New(c)
+	var taskID string
+	err = d.withVMNode(func() error {
+		req.Node = d.Node
+		taskID, err = s.Create(context.Background(), req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return d.waitForTaskToComplete(context.Background(), taskID, 10*time.Minute)
+}
+
+// ListSnapshots returns the VM's snapshots, oldest first
+func (d *Driver) ListSnapshots() ([]snapshot.IndexResponse, error) {
+	if d.VMID < 1 {
+		return nil, errors.New("invalid VMID")
+	}
+
+	c, err := d.EnsureClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var resp []snapshot.IndexResponse
+	err = d.withVMNode(func() error {
+		resp, err = snapshot.New(c).Index(context.Background(), snapshot.IndexRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snaps := []snapshot.IndexResponse{}
+	for _, snap := range resp {
+		// 'current' is the running state, not a snapshot
+		if snap.Name == "current" {
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.SliceStable(snaps, func(i, j int) bool {
+		return snapTime(snaps[i]) < snapTime(snaps[j])
+	})
+	return snaps, nil
+}
+
+// RollbackSnapshot reverts the VM to the named snapshot
+func (d *Driver) RollbackSnapshot(name string) error {
+	if d.VMID < 1 {
+		return errors.New("invalid VMID")
+	}
+
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	d.debugf("rolling back to snapshot %s", name)
+	s := snapshot.New(c)
+	var taskID string
+	err = d.withVMNode(func() error {
+		taskID, err = s.Rollback(context.Background(), snapshot.RollbackRequest{
+			Node:     d.Node,
+			Vmid:     d.VMID,
+			Snapname: name,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return d.waitForTaskToComplete(context.Background(), taskID, 10*time.Minute)
+}
+
+// DeleteSnapshot removes the named snapshot
+func (d *Driver) DeleteSnapshot(name string) error {
+	if d.VMID < 1 {
+		return errors.New("invalid VMID")
+	}
+
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	d.debugf("deleting snapshot %s", name)
+	s := snapshot.New(c)
+	var taskID string
+	err = d.withVMNode(func() error {
+		taskID, err = s.Delete(context.Background(), snapshot.DeleteRequest{
+			Node:     d.Node,
+			Vmid:     d.VMID,
+			Snapname: name,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return d.waitForTaskToComplete(context.Background(), taskID, 10*time.Minute)
+}
+
+// autoSnapshot takes a snapshot ahead of a risky operation and prunes old
+// automatic snapshots beyond the retention limit
+func (d *Driver) autoSnapshot(reason string) error {
+	name := fmt.Sprintf("%s%s-%s", autoSnapshotPrefix, reason, time.Now().Format("20060102-150405"))
+	err := d.CreateSnapshot(
+		name,
+		fmt.Sprintf("docker-machine snapshot before %s", reason),
+		d.SnapshotWithRAM,
+		d.SnapshotFreezeFS,
+	)
+	if err != nil {
+		return fmt.Errorf("could not snapshot before %s: %w", reason, err)
+	}
+	return d.pruneSnapshots()
+}
+
+func (d *Driver) pruneSnapshots() error {
+	if d.SnapshotRetention < 1 {
+		return nil
+	}
+
+	snaps, err := d.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	auto := []string{}
+	for _, snap := range snaps {
+		if strings.HasPrefix(snap.Name, autoSnapshotPrefix) {
+			auto = append(auto, snap.Name)
+		}
+	}
+	for len(auto) > d.SnapshotRetention {
+		err = d.DeleteSnapshot(auto[0])
+		if err != nil {
+			return err
+		}
+		auto = auto[1:]
+	}
+	return nil
+}
+
+// checkAgent makes sure the guest agent answers, which Proxmox VE needs to
+// freeze the guest filesystems while taking a disk-only snapshot
+func (d *Driver) checkAgent() error {
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	err = d.withVMNode(func() error {
+		_, err := agent.New(c).Ping(context.Background(), agent.PingRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("guest agent unavailable to freeze filesystems: %w", err)
+	}
+	return nil
+}
+
+func snapTime(snap snapshot.IndexResponse) int {
+	if snap.Snaptime == nil {
+		return 0
+	}
+	return *snap.Snaptime
+}
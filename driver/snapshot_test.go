@@ -0,0 +1,70 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruneSnapshots(t *testing.T) {
+	deleted := []string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve1/qemu/100/snapshot":
+			fmt.Fprint(w, `{"data":[
+				{"name":"current","description":"You are here!"},
+				{"name":"dm-auto-upgrade-3","snaptime":300},
+				{"name":"manual","snaptime":50},
+				{"name":"dm-auto-restart-1","snaptime":100},
+				{"name":"dm-auto-upgrade-2","snaptime":200}
+			]}`)
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/nodes/pve1/qemu/100/snapshot/"):
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/nodes/pve1/qemu/100/snapshot/"))
+			fmt.Fprint(w, `{"data":"UPID:pve1:delete"}`)
+		case strings.HasPrefix(r.URL.Path, "/nodes/pve1/tasks/"):
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		Node:              "pve1",
+		VMID:              100,
+		SnapshotRetention: 1,
+		client:            proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.pruneSnapshots())
+	assert.Equal(t, []string{"dm-auto-restart-1", "dm-auto-upgrade-2"}, deleted)
+}
+
+func TestCreateSnapshotFreezeFS(t *testing.T) {
+	pinged := false
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/nodes/pve1/qemu/100/agent/ping":
+			pinged = true
+			fmt.Fprint(w, `{"data":{}}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/nodes/pve1/qemu/100/snapshot":
+			fmt.Fprint(w, `{"data":"UPID:pve1:snapshot"}`)
+		case strings.HasPrefix(r.URL.Path, "/nodes/pve1/tasks/"):
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		Node:   "pve1",
+		VMID:   100,
+		client: proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.CreateSnapshot("snap", "", false, true))
+	assert.True(t, pinged)
+	assert.ErrorIs(t, d.CreateSnapshot("snap", "", true, true), errFreezeWithRAM)
+}
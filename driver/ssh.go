@@ -2,20 +2,51 @@ package driver
 
 import (
 	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	ignition "github.com/coreos/ignition/v2/config/v3_4/types"
 	mcnssh "github.com/docker/machine/libmachine/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	keyTypeRSA     = "rsa"
+	keyTypeEd25519 = "ed25519"
+
+	defaultGitLabURL = "https://gitlab.com"
 )
 
 func (d *Driver) generateKey() (string, error) {
+	if d.SSHKeyFile != "" {
+		return d.copyKey()
+	}
+
 	// create and save a new SSH key pair
-	d.debug("creating new ssh keypair")
-	if err := mcnssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
-		return "", fmt.Errorf("could not generate ssh key: %w", err)
+	d.debugf("creating new %s ssh keypair", d.SSHKeyType)
+	switch d.SSHKeyType {
+	case keyTypeEd25519:
+		d.SSHKeyPath = d.ResolveStorePath("id_ed25519")
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", fmt.Errorf("could not generate ssh key: %w", err)
+		}
+		if err := writeKeyPair(d.GetSSHKeyPath(), priv); err != nil {
+			return "", err
+		}
+	default:
+		if err := mcnssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
+			return "", fmt.Errorf("could not generate ssh key: %w", err)
+		}
 	}
 	buf, err := os.ReadFile(d.GetSSHKeyPath() + ".pub")
 	if err != nil {
@@ -24,39 +55,129 @@ func (d *Driver) generateKey() (string, error) {
 	return string(buf), nil
 }
 
+// copyKey copies the existing private key SSHKeyFile into the machine store,
+// deriving the public key from it
+func (d *Driver) copyKey() (string, error) {
+	d.debugf("using existing ssh key %s", d.SSHKeyFile)
+	buf, err := os.ReadFile(d.SSHKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read ssh key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return "", fmt.Errorf("could not parse ssh key %s, passphrase protected keys are not supported: %w", d.SSHKeyFile, err)
+	}
+	pub := ssh.MarshalAuthorizedKey(signer.PublicKey())
+
+	if err := os.WriteFile(d.GetSSHKeyPath(), buf, 0600); err != nil {
+		return "", fmt.Errorf("could not copy ssh key: %w", err)
+	}
+	if err := os.WriteFile(d.GetSSHKeyPath()+".pub", pub, 0644); err != nil {
+		return "", fmt.Errorf("could not write ssh public key: %w", err)
+	}
+	return string(pub), nil
+}
+
+func writeKeyPair(path string, priv crypto.PrivateKey) error {
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return fmt.Errorf("could not encode ssh key: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return fmt.Errorf("could not encode ssh key: %w", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return fmt.Errorf("could not write ssh key: %w", err)
+	}
+	if err := os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		return fmt.Errorf("could not write ssh public key: %w", err)
+	}
+	return nil
+}
+
+// importSSHKeys collects the public keys of the comma separated SSHImportID
+// sources, e.g. gh:user,gl:user,lp:user,url:https://host/keys,file:/path
 func (d *Driver) importSSHKeys() ([]ignition.SSHAuthorizedKey, error) {
 	keys := []ignition.SSHAuthorizedKey{}
-	if d.SSHImportID == "" {
-		return keys, nil
+	seen := map[string]bool{}
+	for _, source := range strings.Split(d.SSHImportID, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		d.debugf("importing ssh keys from %s", source)
+
+		buf, err := d.readKeySource(source)
+		if err != nil {
+			return keys, fmt.Errorf("could not import keys from %s: %w", source, err)
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(buf))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return keys, fmt.Errorf("invalid ssh public key from %s: %w", source, err)
+			}
+			id := string(pub.Marshal())
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			keys = append(keys, ignition.SSHAuthorizedKey(line))
+		}
+		if err := scanner.Err(); err != nil {
+			return keys, err
+		}
 	}
-	d.debugf("pulling github keys")
+	return keys, nil
+}
 
-	parts := strings.Split(d.SSHImportID, ":")
-	if len(parts) != 2 {
-		return keys, fmt.Errorf("Invalid import id %s should look like gh:UserName", d.SSHImportID)
+func (d *Driver) readKeySource(source string) ([]byte, error) {
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid import id %s should look like gh:UserName", source)
 	}
 
 	url := ""
-	if parts[0] == "gh" {
-		url = "https://github.com/%s.keys"
-	} else if parts[0] == "lp" {
-		url = "https://launchpad.net/~%s/+sshkeys"
-	} else {
-		return keys, fmt.Errorf("Invalid import type should be one of (gh, lp) got '%s'", parts[0])
+	switch parts[0] {
+	case "gh":
+		url = fmt.Sprintf("https://github.com/%s.keys", parts[1])
+	case "lp":
+		url = fmt.Sprintf("https://launchpad.net/~%s/+sshkeys", parts[1])
+	case "gl":
+		base := d.SSHImportGitLabURL
+		if base == "" {
+			base = defaultGitLabURL
+		}
+		url = fmt.Sprintf("%s/%s.keys", strings.TrimSuffix(base, "/"), parts[1])
+	case "url":
+		if !strings.HasPrefix(parts[1], "https://") {
+			return nil, fmt.Errorf("key url must use https")
+		}
+		url = parts[1]
+	case "file":
+		return os.ReadFile(parts[1])
+	default:
+		return nil, fmt.Errorf("Invalid import type should be one of (gh, gl, lp, url, file) got '%s'", parts[0])
 	}
 
-	resp, err := http.Get(fmt.Sprintf(url, parts[1]))
-	if err != nil {
-		return keys, err
+	timeout := time.Duration(d.SSHImportTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
 	}
-	if resp.StatusCode != 200 {
-		return keys, fmt.Errorf("received non 200 from key import '%d'", resp.StatusCode)
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
 	}
-
 	defer resp.Body.Close()
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		keys = append(keys, ignition.SSHAuthorizedKey(strings.TrimSpace(scanner.Text())))
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("received non 200 from key import '%d'", resp.StatusCode)
 	}
-	return keys, nil
+	return io.ReadAll(resp.Body)
 }
@@ -0,0 +1,98 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ignition "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newKeyTestDriver(t *testing.T) *Driver {
+	store := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(store, "machines", "test"), 0700))
+	return &Driver{
+		BaseDriver: &drivers.BaseDriver{
+			MachineName: "test",
+			StorePath:   store,
+		},
+	}
+}
+
+func TestGenerateKeyEd25519(t *testing.T) {
+	d := newKeyTestDriver(t)
+	d.SSHKeyType = keyTypeEd25519
+
+	pub, err := d.generateKey()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(pub, "ssh-ed25519 "))
+	assert.Equal(t, "id_ed25519", filepath.Base(d.GetSSHKeyPath()))
+
+	buf, err := os.ReadFile(d.GetSSHKeyPath())
+	require.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey(buf)
+	require.NoError(t, err)
+	assert.Equal(t, pub, string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func TestGenerateKeyExisting(t *testing.T) {
+	src := newKeyTestDriver(t)
+	src.SSHKeyType = keyTypeEd25519
+	pub, err := src.generateKey()
+	require.NoError(t, err)
+
+	d := newKeyTestDriver(t)
+	d.SSHKeyFile = src.GetSSHKeyPath()
+	copied, err := d.generateKey()
+	require.NoError(t, err)
+	assert.Equal(t, pub, copied)
+
+	want, _ := os.ReadFile(src.GetSSHKeyPath())
+	got, err := os.ReadFile(d.GetSSHKeyPath())
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	d.SSHKeyFile = filepath.Join(t.TempDir(), "missing")
+	_, err = d.generateKey()
+	assert.Error(t, err)
+}
+
+func TestImportSSHKeys(t *testing.T) {
+	keyA := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKQ6sWbUbAoFLyoKg9fHWBY5ukHP4NhTRzStRJp9bSfU a@host"
+	keyB := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGV2Wb6q0aTc9C9WCfNXs6ZxL8DZ6iWkxf1b2jeWbUFd b@host"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/alice.keys":
+			fmt.Fprintf(w, "%s\n%s\n", keyA, keyB)
+		case "/broken.keys":
+			fmt.Fprint(w, "not a key\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	file := filepath.Join(t.TempDir(), "authorized_keys")
+	// same key as keyA with a different comment
+	require.NoError(t, os.WriteFile(file, []byte("# laptop\n\n"+strings.TrimSuffix(keyA, " a@host")+" other\n"), 0600))
+
+	d := &Driver{SSHImportGitLabURL: s.URL + "/"}
+	d.SSHImportID = "gl:alice, file:" + file
+	keys, err := d.importSSHKeys()
+	require.NoError(t, err)
+	assert.Equal(t, []ignition.SSHAuthorizedKey{ignition.SSHAuthorizedKey(keyA), ignition.SSHAuthorizedKey(keyB)}, keys)
+
+	for _, id := range []string{"gl:broken", "gl:missing", "url:http://insecure/keys", "xx:bob", "gh"} {
+		d.SSHImportID = id
+		_, err = d.importSSHKeys()
+		assert.Error(t, err, id)
+	}
+}
@@ -3,10 +3,14 @@ package driver
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu/agent"
 	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu/status"
 	"github.com/docker/machine/libmachine/state"
+	"github.com/labstack/gommon/log"
 )
 
 // GetState returns the state of the VM
@@ -21,25 +25,68 @@ func (d *Driver) GetState() (state.State, error) {
 	}
 
 	s := status.New(c)
-	resp, err := s.VmStatusCurrent(context.Background(), status.VmStatusCurrentRequest{
-		Node: d.Node,
-		Vmid: d.VMID,
+	var resp status.VmStatusCurrentResponse
+	err = d.withVMNode(func() error {
+		resp, err = s.VmStatusCurrent(context.Background(), status.VmStatusCurrentRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+		})
+		return err
 	})
 	if err != nil {
 		return state.Error, err
 	}
 
+	return vmState(resp), nil
+}
+
+// vmState maps the Proxmox VE status, QMP status and config lock of a VM onto
+// the docker-machine state
+func vmState(resp status.VmStatusCurrentResponse) state.State {
+	lock := ""
+	if resp.Lock != nil {
+		lock = *resp.Lock
+	}
+	qmp := ""
+	if resp.Qmpstatus != nil {
+		qmp = *resp.Qmpstatus
+	}
+
+	switch lock {
+	case "suspended":
+		return state.Saved
+	case "suspending":
+		return state.Stopping
+	case "create", "clone", "rollback":
+		return state.Starting
+	}
+
 	if resp.Status == status.Status_STOPPED {
-		return state.Stopped, nil
+		return state.Stopped
 	}
-	if resp.Status == status.Status_RUNNING {
-		return state.Running, nil
+	if resp.Status != status.Status_RUNNING {
+		return state.Error
 	}
-	return state.Error, nil
+
+	switch qmp {
+	case "", "running", "finish-migrate", "postmigrate":
+		return state.Running
+	case "paused", "suspended", "debug":
+		return state.Paused
+	case "prelaunch", "inmigrate", "restore-vm":
+		return state.Starting
+	case "shutdown", "save-vm":
+		return state.Stopping
+	}
+	return state.Error
 }
 
 // Start starts the VM
 func (d *Driver) Start() error {
+	return d.start(context.Background())
+}
+
+func (d *Driver) start(ctx context.Context) error {
 	if d.VMID < 1 {
 		return errors.New("invalid VMID")
 	}
@@ -49,20 +96,70 @@ func (d *Driver) Start() error {
 		return err
 	}
 
+	// a VM suspended to RAM has to be resumed, one suspended to disk is
+	// restored by a regular start
+	st, err := d.GetState()
+	if err != nil {
+		return err
+	}
+	if st == state.Paused {
+		return d.Resume()
+	}
+
 	s := status.New(c)
-	taskID, err := s.VmStart(context.Background(), status.VmStartRequest{
-		Node: d.Node,
+	var taskID string
+	err = d.withVMNode(func() error {
+		taskID, err = s.VmStart(ctx, status.VmStartRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.waitForTaskToComplete(ctx, taskID, 2*time.Minute)
+}
+
+// Suspend pauses the VM in RAM, or saves its state to stateStorage and stops
+// it when toDisk is set
+func (d *Driver) Suspend(toDisk bool, stateStorage string) error {
+	if d.VMID < 1 {
+		return errors.New("invalid VMID")
+	}
+
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	req := status.VmSuspendRequest{
 		Vmid: d.VMID,
+	}
+	if toDisk {
+		req.Todisk = proxmox.PVEBool(true)
+		if stateStorage != "" {
+			req.Statestorage = proxmox.String(stateStorage)
+		}
+	}
+
+	s := status.New(c)
+	var taskID string
+	err = d.withVMNode(func() error {
+		req.Node = d.Node
+		taskID, err = s.VmSuspend(context.Background(), req)
+		return err
 	})
 	if err != nil {
 		return err
 	}
 
-	return d.waitForTaskToComplete(taskID, 2*time.Minute)
+	return d.waitForTaskToComplete(context.Background(), taskID, 10*time.Minute)
 }
 
-// Stop stopps the VM
-func (d *Driver) Stop() error {
+// Resume continues a VM suspended to RAM
+func (d *Driver) Resume() error {
 	if d.VMID < 1 {
 		return errors.New("invalid VMID")
 	}
@@ -73,15 +170,82 @@ func (d *Driver) Stop() error {
 	}
 
 	s := status.New(c)
-	taskID, err := s.VmShutdown(context.Background(), status.VmShutdownRequest{
-		Node: d.Node,
-		Vmid: d.VMID,
+	var taskID string
+	err = d.withVMNode(func() error {
+		taskID, err = s.VmResume(context.Background(), status.VmResumeRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+		})
+		return err
 	})
 	if err != nil {
 		return err
 	}
 
-	return d.waitForTaskToComplete(taskID, 10*time.Minute)
+	return d.waitForTaskToComplete(context.Background(), taskID, 2*time.Minute)
+}
+
+// Stop gracefully shuts down the VM, through the guest agent when available
+// and the VM is not HA managed, and forces it off if it has not stopped within
+// the shutdown timeout
+func (d *Driver) Stop() error {
+	if d.VMID < 1 {
+		return errors.New("invalid VMID")
+	}
+
+	c, err := d.EnsureClient()
+	if err != nil {
+		return err
+	}
+
+	timeout := d.shutdownTimeout()
+	useAgent := !d.HAEnabled
+	if useAgent {
+		err = d.withVMNode(func() error {
+			_, err := agent.New(c).Shutdown(context.Background(), agent.ShutdownRequest{
+				Node: d.Node,
+				Vmid: d.VMID,
+			})
+			return err
+		})
+		if err != nil {
+			d.debugf("guest agent shutdown unavailable, using ACPI: %v", err)
+			useAgent = false
+		}
+	} else {
+		// the HA manager boots a VM powered off from inside the guest again,
+		// a shutdown through Proxmox VE becomes an HA state change instead
+		d.debugf("VM is HA managed, requesting shutdown through Proxmox VE")
+	}
+	if useAgent {
+		d.debugf("requested shutdown through guest agent")
+		err = d.waitForState(state.Stopped, timeout)
+	} else {
+		s := status.New(c)
+		var taskID string
+		err = d.withVMNode(func() error {
+			taskID, err = s.VmShutdown(context.Background(), status.VmShutdownRequest{
+				Node:    d.Node,
+				Vmid:    d.VMID,
+				Timeout: proxmox.Int(int(timeout.Seconds())),
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		err = d.waitForTaskToComplete(context.Background(), taskID, timeout+time.Minute)
+		if err == nil && d.HAEnabled {
+			// the task only hands the request to the HA manager
+			err = d.waitForState(state.Stopped, timeout)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	log.Warnf("Graceful shutdown of VM %d failed, forcing stop: %v", d.VMID, err)
+	return d.Kill()
 }
 
 // Restart restarts the VM
@@ -90,25 +254,40 @@ func (d *Driver) Restart() error {
 		return errors.New("invalid VMID")
 	}
 
+	if d.SnapshotBeforeRestart {
+		err := d.autoSnapshot("restart")
+		if err != nil {
+			return err
+		}
+	}
+
 	c, err := d.EnsureClient()
 	if err != nil {
 		return err
 	}
 
 	s := status.New(c)
-	taskID, err := s.VmReboot(context.Background(), status.VmRebootRequest{
-		Node: d.Node,
-		Vmid: d.VMID,
+	var taskID string
+	err = d.withVMNode(func() error {
+		taskID, err = s.VmReboot(context.Background(), status.VmRebootRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+		})
+		return err
 	})
 	if err != nil {
 		return err
 	}
 
-	return d.waitForTaskToComplete(taskID, 10*time.Minute)
+	return d.waitForTaskToComplete(context.Background(), taskID, 10*time.Minute)
 }
 
 // Kill the VM immediately
 func (d *Driver) Kill() error {
+	return d.kill(context.Background())
+}
+
+func (d *Driver) kill(ctx context.Context) error {
 	if d.VMID < 1 {
 		return errors.New("invalid VMID")
 	}
@@ -119,13 +298,40 @@ func (d *Driver) Kill() error {
 	}
 
 	s := status.New(c)
-	taskID, err := s.VmStop(context.Background(), status.VmStopRequest{
-		Node: d.Node,
-		Vmid: d.VMID,
+	var taskID string
+	err = d.withVMNode(func() error {
+		taskID, err = s.VmStop(ctx, status.VmStopRequest{
+			Node: d.Node,
+			Vmid: d.VMID,
+		})
+		return err
 	})
 	if err != nil {
 		return err
 	}
 
-	return d.waitForTaskToComplete(taskID, 10*time.Minute)
+	return d.waitForTaskToComplete(ctx, taskID, 10*time.Minute)
+}
+
+func (d *Driver) shutdownTimeout() time.Duration {
+	if d.ShutdownTimeout <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(d.ShutdownTimeout) * time.Second
+}
+
+// waitForState polls the VM until it reaches st
+func (d *Driver) waitForState(st state.State, dur time.Duration) error {
+	endTime := time.Now().Add(dur)
+	for !time.Now().After(endTime) {
+		current, err := d.GetState()
+		if err != nil {
+			return err
+		}
+		if current == st {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("timed out waiting for VM to be %s", st)
 }
@@ -0,0 +1,220 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu/status"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// writePVEError mimics Proxmox VE, which reports the error message in the
+// HTTP status line
+func writePVEError(t *testing.T, w http.ResponseWriter, code int, msg string) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	assert.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, msg)
+	buf.Flush()
+}
+
+// movedVMServer serves a VM 100 that was created on pve1 but now lives on pve2
+func movedVMServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/nodes/pve1/qemu/100") {
+			writePVEError(t, w, 500, "Configuration file 'nodes/pve1/qemu-server/100.conf' does not exist")
+			return
+		}
+		switch {
+		case r.URL.Path == "/cluster/resources":
+			assert.Equal(t, "vm", r.URL.Query().Get("type"))
+			fmt.Fprint(w, `{"data":[{"id":"qemu/101","type":"qemu","vmid":101,"node":"pve1"},{"id":"qemu/100","type":"qemu","vmid":100,"node":"pve2"}]}`)
+		case r.URL.Path == "/nodes/pve2/qemu/100/status/current":
+			fmt.Fprint(w, `{"data":{"status":"running","vmid":100}}`)
+		case strings.HasPrefix(r.URL.Path, "/nodes/pve2/qemu/100/status/"):
+			fmt.Fprint(w, `{"data":"UPID:pve2:1"}`)
+		case strings.HasPrefix(r.URL.Path, "/nodes/pve2/tasks/"):
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestGetStateMovedVM(t *testing.T) {
+	s := movedVMServer(t)
+	defer s.Close()
+	d := &Driver{
+		Node:   "pve1",
+		VMID:   100,
+		client: proxmox.NewClient(s.URL),
+	}
+	st, err := d.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, state.Running, st)
+	assert.Equal(t, "pve2", d.Node)
+}
+
+func TestKillMovedVM(t *testing.T) {
+	s := movedVMServer(t)
+	defer s.Close()
+	d := &Driver{
+		Node:   "pve1",
+		VMID:   100,
+		client: proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.Kill())
+	assert.Equal(t, "pve2", d.Node)
+}
+
+func TestGetStateMissingVM(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cluster/resources" {
+			fmt.Fprint(w, `{"data":[]}`)
+			return
+		}
+		writePVEError(t, w, 500, "Configuration file 'nodes/pve1/qemu-server/100.conf' does not exist")
+	}))
+	defer s.Close()
+	d := &Driver{
+		Node:   "pve1",
+		VMID:   100,
+		client: proxmox.NewClient(s.URL),
+	}
+	st, err := d.GetState()
+	assert.Error(t, err)
+	assert.Equal(t, state.Error, st)
+	assert.Equal(t, "pve1", d.Node)
+}
+
+func TestStopFallsBackToForcedStop(t *testing.T) {
+	stopped := false
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nodes/pve1/qemu/100/agent/shutdown":
+			writePVEError(t, w, 500, "QEMU guest agent is not running")
+		case "/nodes/pve1/qemu/100/status/shutdown":
+			fmt.Fprint(w, `{"data":"UPID:pve1:shutdown"}`)
+		case "/nodes/pve1/qemu/100/status/stop":
+			stopped = true
+			fmt.Fprint(w, `{"data":"UPID:pve1:stop"}`)
+		case "/nodes/pve1/tasks/UPID:pve1:shutdown/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"VM quit/powerdown failed - got timeout"}}`)
+		case "/nodes/pve1/tasks/UPID:pve1:shutdown/log":
+			fmt.Fprint(w, `{"data":[{"n":1,"t":"TASK ERROR: VM quit/powerdown failed - got timeout"}]}`)
+		case "/nodes/pve1/tasks/UPID:pve1:stop/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		Node:            "pve1",
+		VMID:            100,
+		ShutdownTimeout: 1,
+		client:          proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.Stop())
+	assert.True(t, stopped)
+}
+
+func TestStopHAManaged(t *testing.T) {
+	requests := []string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		switch r.URL.Path {
+		case "/nodes/pve1/qemu/100/status/shutdown":
+			fmt.Fprint(w, `{"data":"UPID:pve1:hastop"}`)
+		case "/nodes/pve1/tasks/UPID:pve1:hastop/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		case "/nodes/pve1/qemu/100/status/current":
+			fmt.Fprint(w, `{"data":{"status":"stopped"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		Node:            "pve1",
+		VMID:            100,
+		HAEnabled:       true,
+		ShutdownTimeout: 1,
+		client:          proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.Stop())
+	assert.Equal(t, []string{
+		"/nodes/pve1/qemu/100/status/shutdown",
+		"/nodes/pve1/tasks/UPID:pve1:hastop/status",
+		"/nodes/pve1/qemu/100/status/current",
+	}, requests)
+}
+
+func TestVMState(t *testing.T) {
+	tests := []struct {
+		status string
+		qmp    string
+		lock   string
+		state  state.State
+	}{
+		{status: "stopped", state: state.Stopped},
+		{status: "running", qmp: "running", state: state.Running},
+		{status: "running", state: state.Running},
+		{status: "running", qmp: "paused", state: state.Paused},
+		{status: "running", qmp: "suspended", state: state.Paused},
+		{status: "running", qmp: "prelaunch", state: state.Starting},
+		{status: "running", qmp: "inmigrate", state: state.Starting},
+		{status: "running", qmp: "shutdown", state: state.Stopping},
+		{status: "running", qmp: "internal-error", state: state.Error},
+		{status: "stopped", lock: "suspended", state: state.Saved},
+		{status: "running", qmp: "running", lock: "suspending", state: state.Stopping},
+		{status: "running", qmp: "running", lock: "migrate", state: state.Running},
+		{status: "running", qmp: "running", lock: "backup", state: state.Running},
+		{status: "stopped", lock: "backup", state: state.Stopped},
+		{status: "stopped", lock: "rollback", state: state.Starting},
+		{status: "unknown", state: state.Error},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s/%s/%s", tc.status, tc.qmp, tc.lock), func(t *testing.T) {
+			resp := status.VmStatusCurrentResponse{Status: status.Status(tc.status)}
+			if tc.qmp != "" {
+				resp.Qmpstatus = proxmox.String(tc.qmp)
+			}
+			if tc.lock != "" {
+				resp.Lock = proxmox.String(tc.lock)
+			}
+			assert.Equal(t, tc.state, vmState(resp))
+		})
+	}
+}
+
+func TestStartResumesPausedVM(t *testing.T) {
+	resumed := false
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nodes/pve1/qemu/100/status/current":
+			fmt.Fprint(w, `{"data":{"status":"running","qmpstatus":"paused","vmid":100}}`)
+		case "/nodes/pve1/qemu/100/status/resume":
+			resumed = true
+			fmt.Fprint(w, `{"data":"UPID:pve1:resume"}`)
+		case "/nodes/pve1/tasks/UPID:pve1:resume/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		Node:   "pve1",
+		VMID:   100,
+		client: proxmox.NewClient(s.URL),
+	}
+	assert.NoError(t, d.Start())
+	assert.True(t, resumed)
+}
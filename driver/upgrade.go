@@ -0,0 +1,177 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// zincatiPause is a zincati drop-in turning automatic updates off after a
+// rollback, so the failing update is not applied again
+const zincatiPause = "/etc/zincati/config.d/90-docker-machine-pause.toml"
+
+// Upgrade updates Fedora CoreOS machines provisioned with ignition to the
+// latest deployment, rolling back and pausing automatic updates if docker does
+// not come up afterwards. A successful upgrade resumes automatic updates.
+func (d *Driver) Upgrade() error {
+	if !d.usesIgnition() {
+		return fmt.Errorf("%s was not provisioned with ignition by the driver, upgrade its OS yourself", d.GetMachineName())
+	}
+	if d.SnapshotBeforeUpgrade {
+		err := d.autoSnapshot("upgrade")
+		if err != nil {
+			return err
+		}
+	}
+
+	before, err := d.bootedDeployment()
+	if err != nil {
+		return err
+	}
+	log.Infof("Upgrading %s from %s", d.GetMachineName(), before.Version)
+
+	// stop zincati so it does not race us for the update
+	out, err := d.RunCommand("sudo systemctl stop zincati.service && sudo rpm-ostree upgrade")
+	if err != nil {
+		return fmt.Errorf("rpm-ostree upgrade failed: %w: %s", err, out)
+	}
+	if strings.Contains(out, "No upgrade available") {
+		log.Infof("%s is already up to date", d.GetMachineName())
+		_, err = d.RunCommand("sudo systemctl start zincati.service")
+		return err
+	}
+
+	err = d.rebootAndWait()
+	if err != nil {
+		return err
+	}
+	after, err := d.bootedDeployment()
+	if err != nil {
+		return err
+	}
+	if after.Checksum == before.Checksum {
+		return fmt.Errorf("%s is still booted into %s after upgrading", d.GetMachineName(), before.Version)
+	}
+
+	err = d.checkDocker(context.Background())
+	if err != nil {
+		log.Warnf("Docker did not come up on %s, rolling back to %s: %v", after.Version, before.Version, err)
+		out, rerr := d.RunCommand(fmt.Sprintf(
+			"printf '[updates]\\nenabled = false\\n' | sudo tee %s >/dev/null && sudo rpm-ostree rollback",
+			zincatiPause,
+		))
+		if rerr != nil {
+			return fmt.Errorf("docker failed after upgrade (%v) and rollback failed: %w: %s", err, rerr, out)
+		}
+		rerr = d.rebootAndWait()
+		if rerr != nil {
+			return fmt.Errorf("docker failed after upgrade (%v) and rollback failed: %w", err, rerr)
+		}
+		return fmt.Errorf(
+			"docker failed after upgrade to %s, rolled back to %s and paused automatic updates (remove %s to resume): %w",
+			after.Version, before.Version, zincatiPause, err,
+		)
+	}
+
+	out, err = d.RunCommand("sudo rm -f " + zincatiPause)
+	if err != nil {
+		return fmt.Errorf("could not resume automatic updates: %w: %s", err, out)
+	}
+
+	log.Infof("Upgraded %s to %s", d.GetMachineName(), after.Version)
+	return nil
+}
+
+// usesIgnition reports whether the driver provisioned the machine with
+// ignition, which is the default strategy. Adopted VMs were provisioned by
+// someone else and may not run Fedora CoreOS at all.
+func (d *Driver) usesIgnition() bool {
+	if d.Adopt != "" {
+		return false
+	}
+	return d.ProvisionStrategy == "" || d.ProvisionStrategy == "ignition"
+}
+
+type deployment struct {
+	Booted   bool   `json:"booted"`
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+}
+
+func (d *Driver) bootedDeployment() (deployment, error) {
+	out, err := d.RunCommand("rpm-ostree status --json")
+	if err != nil {
+		return deployment{}, fmt.Errorf("could not read rpm-ostree status: %w", err)
+	}
+	return parseBootedDeployment(out)
+}
+
+func parseBootedDeployment(out string) (deployment, error) {
+	status := struct {
+		Deployments []deployment `json:"deployments"`
+	}{}
+	err := json.Unmarshal([]byte(out), &status)
+	if err != nil {
+		return deployment{}, fmt.Errorf("could not parse rpm-ostree status: %w", err)
+	}
+	for _, dep := range status.Deployments {
+		if dep.Booted {
+			return dep, nil
+		}
+	}
+	return deployment{}, fmt.Errorf("no booted deployment in rpm-ostree status")
+}
+
+// rebootAndWait reboots the guest and waits until it is reachable again with
+// a new boot ID
+func (d *Driver) rebootAndWait() error {
+	bootID, err := d.RunCommand("cat /proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return err
+	}
+
+	d.debugf("rebooting %s", d.GetMachineName())
+	// the connection drops as the guest goes down
+	_, _ = d.RunCommand("sudo systemctl reboot")
+
+	endTime := time.Now().Add(10 * time.Minute)
+	for !time.Now().After(endTime) {
+		time.Sleep(5 * time.Second)
+		err = d.waitForNetwork(context.Background())
+		if err != nil {
+			return err
+		}
+		err = d.writeKnownHosts()
+		if err != nil {
+			return err
+		}
+		current, err := d.RunCommand("cat /proc/sys/kernel/random/boot_id")
+		if err != nil {
+			d.debugf("waiting for %s to come back: %v", d.GetMachineName(), err)
+			continue
+		}
+		if current != bootID {
+			return nil
+		}
+	}
+	return fmt.Errorf("timed out waiting for %s to reboot", d.GetMachineName())
+}
+
+// checkDocker waits for the docker daemon to answer
+func (d *Driver) checkDocker(ctx context.Context) error {
+	b := backoff{
+		Initial:    5 * time.Second,
+		Max:        5 * time.Second,
+		MaxElapsed: 2 * time.Minute,
+		// docker failing to answer is what we are waiting out
+		Retryable: func(error) bool { return true },
+	}
+	return d.retry(ctx, b, func() error {
+		_, err := d.RunCommand("sudo docker version --format '{{.Server.Version}}'")
+		return err
+	})
+}
@@ -0,0 +1,38 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBootedDeployment(t *testing.T) {
+	out := `{
+  "deployments": [
+    {"id": "fedora-coreos-b", "booted": false, "version": "39.20240112.3.0", "checksum": "bbb"},
+    {"id": "fedora-coreos-a", "booted": true, "version": "39.20231204.3.3", "checksum": "aaa"}
+  ],
+  "transaction": null
+}`
+	dep, err := parseBootedDeployment(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "39.20231204.3.3", dep.Version)
+	assert.Equal(t, "aaa", dep.Checksum)
+
+	_, err = parseBootedDeployment(`{"deployments":[]}`)
+	assert.Error(t, err)
+
+	_, err = parseBootedDeployment(`not json`)
+	assert.Error(t, err)
+}
+
+func TestUpgradeRefusesAdopted(t *testing.T) {
+	d := &Driver{
+		BaseDriver:            &drivers.BaseDriver{MachineName: "test"},
+		VMID:                  100,
+		Adopt:                 "web",
+		SnapshotBeforeUpgrade: true,
+	}
+	assert.ErrorContains(t, d.Upgrade(), "not provisioned with ignition")
+}
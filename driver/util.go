@@ -1,6 +1,19 @@
 package driver
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/labstack/gommon/log"
@@ -18,17 +31,162 @@ func (d *Driver) debug(v ...interface{}) {
 	}
 }
 
+// signalContext returns a context cancelled on interrupt or termination, letting
+// long running operations stop their tasks and clean up
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// sleep waits for dur, returning early with the error of ctx once it is done
+func sleep(ctx context.Context, dur time.Duration) error {
+	t := time.NewTimer(dur)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
 type retryfunc func() error
 
-func (dr *Driver) retry(f retryfunc, d time.Duration, c int) error {
-	var err error
-	for i := 0; i < c; i++ {
-		err = f()
+// backoff is a retry policy: the first retry waits Initial, doubling up to Max,
+// each wait randomised by the Jitter fraction, giving up once MaxElapsed has
+// passed
+type backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Jitter     float64
+	MaxElapsed time.Duration
+
+	// Retryable reports whether an error may go away, isRetryable when nil
+	Retryable func(error) bool
+}
+
+var defaultBackoff = backoff{
+	Initial:    time.Second,
+	Max:        30 * time.Second,
+	Jitter:     0.2,
+	MaxElapsed: 2 * time.Minute,
+}
+
+func (b backoff) delay(attempt int) time.Duration {
+	// shifting Max down rather than Initial up cannot overflow
+	d := b.Max
+	if attempt < 64 && b.Initial < b.Max>>attempt {
+		d = b.Initial << attempt
+	}
+	if b.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * b.Jitter * float64(d))
+	}
+	return d
+}
+
+// retry runs f until it succeeds, fails permanently, ctx is done or the policy
+// gives up, returning the last error of f. An expired ticket is renewed before
+// trying again.
+func (d *Driver) retry(ctx context.Context, b backoff, f retryfunc) error {
+	retryable := b.Retryable
+	if retryable == nil {
+		retryable = isRetryable
+	}
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		err := f()
 		if err == nil {
 			return nil
 		}
-		dr.debugf("error attempting %w", err)
-		time.Sleep(d)
+		if isTicketExpired(err) && d.client != nil {
+			lerr := d.login(ctx, d.client)
+			if lerr != nil {
+				return fmt.Errorf("%w (renewing ticket: %v)", err, lerr)
+			}
+		} else if !retryable(err) {
+			return err
+		}
+
+		wait := b.delay(attempt)
+		if time.Since(start)+wait > b.MaxElapsed {
+			return err
+		}
+		d.debugf("error attempting, retrying in %s: %v", wait, err)
+		if sleep(ctx, wait) != nil {
+			return err
+		}
+	}
+}
+
+var apiStatusRe = regexp.MustCompile(`non 200: (\d{3})`)
+
+// apiStatus returns the HTTP status of a failed API call, 0 if err is not one
+func apiStatus(err error) int {
+	m := apiStatusRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	code, _ := strconv.Atoi(m[1])
+	return code
+}
+
+func isTicketExpired(err error) bool {
+	return apiStatus(err) == http.StatusUnauthorized
+}
+
+// isRetryable reports whether err is transient: a locked VM, a server side
+// error, or a network failure
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "is locked") || strings.Contains(msg, "can't lock file") {
+		return true
+	}
+	if code := apiStatus(err); code != 0 {
+		return code >= 500
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// parseRatio parses an overcommit ratio, treating an empty value as 1
+func parseRatio(s string) (float64, error) {
+	if s == "" {
+		return 1, nil
+	}
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if r <= 0 {
+		return 0, fmt.Errorf("ratio must be greater than zero, got '%s'", s)
+	}
+	return r, nil
+}
+
+var invalidTagChars = regexp.MustCompile(`[^a-z0-9_+.-]+`)
+
+// sanitizeTag converts s into a valid Proxmox VE tag
+func sanitizeTag(s string) string {
+	return strings.Trim(invalidTagChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// hasTag reports whether tag is in a Proxmox VE tag list, which may be
+// separated by semicolons, commas or spaces
+func hasTag(tags string, tag string) bool {
+	for _, t := range strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	}) {
+		if t == tag {
+			return true
+		}
 	}
-	return err
+	return false
 }
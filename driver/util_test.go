@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := map[string]struct {
+		err       error
+		retryable bool
+	}{
+		"server error":      {err: errors.New("non 200: 500 Internal Server Error"), retryable: true},
+		"vm locked":         {err: errors.New("non 200: 500 VM 100 is locked (backup)"), retryable: true},
+		"lock timeout":      {err: errors.New("can't lock file '/var/lock/qemu-server/lock-100.conf' - got timeout"), retryable: true},
+		"permission denied": {err: errors.New("non 200: 403 Permission check failed"), retryable: false},
+		"bad request":       {err: errors.New("non 200: 400 Parameter verification failed"), retryable: false},
+		"connection reset":  {err: fmt.Errorf("read: %w", syscall.ECONNRESET), retryable: true},
+		"unexpected eof":    {err: fmt.Errorf("get: %w", io.ErrUnexpectedEOF), retryable: true},
+		"cancelled":         {err: fmt.Errorf("get: %w", context.Canceled), retryable: false},
+		"other":             {err: errors.New("invalid character"), retryable: false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.retryable, isRetryable(test.err))
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := backoff{Initial: time.Second, Max: 10 * time.Second}
+	assert.Equal(t, time.Second, b.delay(0))
+	assert.Equal(t, 4*time.Second, b.delay(2))
+	assert.Equal(t, 10*time.Second, b.delay(5))
+	assert.Equal(t, 10*time.Second, b.delay(100))
+
+	// time.Hour<<22 overflows a time.Duration
+	long := backoff{Initial: time.Hour, Max: 48 * time.Hour}
+	assert.Equal(t, 32*time.Hour, long.delay(5))
+	assert.Equal(t, 48*time.Hour, long.delay(22))
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := b.delay(1)
+		assert.True(t, d >= time.Second && d <= 3*time.Second, d)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	d := &Driver{}
+	b := backoff{Initial: time.Millisecond, Max: time.Millisecond, MaxElapsed: time.Second}
+
+	calls := 0
+	err := d.retry(context.Background(), b, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("non 200: 500 VM 100 is locked (snapshot)")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = d.retry(context.Background(), b, func() error {
+		calls++
+		return errors.New("non 200: 403 Permission check failed")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	b.MaxElapsed = 20 * time.Millisecond
+	err = d.retry(context.Background(), b, func() error {
+		return errors.New("non 200: 502 Bad Gateway")
+	})
+	assert.EqualError(t, err, "non 200: 502 Bad Gateway")
+}
+
+func TestRetryRenewsTicket(t *testing.T) {
+	logins := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logins++
+		fmt.Fprint(w, `{"data":{"ticket":"PVE:new","CSRFPreventionToken":"csrf","username":"root@pam"}}`)
+	}))
+	defer s.Close()
+	d := &Driver{client: proxmox.NewClient(s.URL)}
+	b := backoff{Initial: time.Millisecond, Max: time.Millisecond, MaxElapsed: time.Second}
+
+	calls := 0
+	err := d.retry(context.Background(), b, func() error {
+		calls++
+		if calls == 1 {
+			return errors.New("non 200: 401 No ticket")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, logins)
+}
@@ -0,0 +1,168 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/cluster"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
+)
+
+const (
+	minVMID = 100
+	maxVMID = 999999999
+
+	// vmidAttempts bounds how often a create moves on to another VMID
+	vmidAttempts = 10
+)
+
+// isVMIDTaken reports whether err is Proxmox VE refusing a VMID another
+// create claimed first
+func isVMIDTaken(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "already exists")
+}
+
+// createVM creates the VM from req, allocating its VMID. created reports
+// whether a VM was created that needs cleaning up on later failures.
+// The VMID is checkpointed before each attempt, so resuming or removing finds
+// the VM even if this process dies before the create returns.
+func (d *Driver) createVM(ctx context.Context, client *proxmox.Client, req qemu.CreateRequest, cp *createCheckpoint) (created bool, err error) {
+	q := qemu.New(client)
+	id, err := d.createWithVMID(ctx, client, 2*time.Minute, func(id int) (string, error) {
+		req.Vmid = id
+		cp.VMID = id
+		cp.Node = d.Node
+		cp.MachineID = d.MachineID
+		cp.SSHKeyPath = d.GetSSHKeyPath()
+		cp.SSHHostKey = d.SSHHostKey
+		err := cp.save()
+		if err != nil {
+			return "", err
+		}
+		return q.Create(ctx, req)
+	})
+	d.VMID = id
+	return id != 0, err
+}
+
+// createWithVMID runs create, which starts a task creating a VM, with VMIDs
+// from the allocator, waiting up to dur for each task. When a concurrent
+// create claims the VMID first, the next free one is tried. It returns the
+// VMID of the created VM, which is also set when the create task failed and
+// left a VM to clean up.
+func (d *Driver) createWithVMID(ctx context.Context, client *proxmox.Client, dur time.Duration, create func(id int) (string, error)) (int, error) {
+	alloc, err := d.newVMIDAllocator(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+
+	for attempt := 0; attempt < vmidAttempts; attempt++ {
+		id, err := alloc.take()
+		if err != nil {
+			return 0, err
+		}
+		d.debugf("Next ID is '%d'", id)
+
+		taskID, err := create(id)
+		if isVMIDTaken(err) {
+			d.debugf("vmid %d already taken, trying the next one", id)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = d.waitForTaskToComplete(ctx, taskID, dur)
+		if isVMIDTaken(err) {
+			// lost the race inside the create task, the VM is not ours
+			d.debugf("vmid %d already taken, trying the next one", id)
+			continue
+		}
+		return id, err
+	}
+	return 0, fmt.Errorf("could not allocate a VMID after %d attempts", vmidAttempts)
+}
+
+// vmidAllocator hands out VMIDs in a range that are not used in the cluster,
+// wrapping around at the end of the range
+type vmidAllocator struct {
+	min, max int
+	next     int
+	used     map[int]bool
+}
+
+func (d *Driver) newVMIDAllocator(ctx context.Context, client *proxmox.Client) (*vmidAllocator, error) {
+	min, max, err := parseVMIDRange(d.VMIDRange)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := cluster.New(client).Resources(ctx, cluster.ResourcesRequest{
+		Type: cluster.PtrType(cluster.Type_VM),
+	})
+	if err != nil {
+		return nil, err
+	}
+	used := map[int]bool{}
+	for _, r := range resources {
+		if r.Vmid != nil {
+			used[*r.Vmid] = true
+		}
+	}
+
+	start := min
+	if d.VMIDFromName {
+		h := fnv.New32a()
+		h.Write([]byte(d.GetMachineName()))
+		start = min + int(h.Sum32()%uint32(max-min+1))
+	} else if d.VMIDRange == "" {
+		// honor the cluster's own next-id settings
+		start, err = cluster.New(client).Nextid(ctx, cluster.NextidRequest{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &vmidAllocator{min: min, max: max, next: start, used: used}, nil
+}
+
+func (a *vmidAllocator) take() (int, error) {
+	for i := 0; i <= a.max-a.min; i++ {
+		id := a.next
+		a.next++
+		if a.next > a.max {
+			a.next = a.min
+		}
+		if !a.used[id] {
+			a.used[id] = true
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no free VMID in %d-%d", a.min, a.max)
+}
+
+// parseVMIDRange parses a MIN-MAX VMID range, an empty range allowing any VMID
+func parseVMIDRange(s string) (int, int, error) {
+	if s == "" {
+		return minVMID, maxVMID, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid VMID range '%s', expected MIN-MAX", s)
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid VMID range '%s': %w", s, err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid VMID range '%s': %w", s, err)
+	}
+	if min < minVMID || max > maxVMID || min > max {
+		return 0, 0, fmt.Errorf("invalid VMID range '%s', must lie within %d-%d", s, minVMID, maxVMID)
+	}
+	return min, max, nil
+}
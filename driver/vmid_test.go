@@ -0,0 +1,96 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/FreekingDean/proxmox-api-go/proxmox"
+	"github.com/FreekingDean/proxmox-api-go/proxmox/nodes/qemu"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVMIDRange(t *testing.T) {
+	tests := map[string]struct {
+		min, max int
+		err      bool
+	}{
+		"":          {min: minVMID, max: maxVMID},
+		"1000-1999": {min: 1000, max: 1999},
+		"1000":      {err: true},
+		"50-200":    {err: true},
+		"2000-1000": {err: true},
+		"a-b":       {err: true},
+	}
+	for in, test := range tests {
+		t.Run(in, func(t *testing.T) {
+			min, max, err := parseVMIDRange(in)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.min, min)
+			assert.Equal(t, test.max, max)
+		})
+	}
+}
+
+func TestCreateVMRetriesTakenVMID(t *testing.T) {
+	tried := []string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/cluster/resources":
+			fmt.Fprint(w, `{"data":[{"id":"qemu/1000","type":"qemu","vmid":1000,"node":"pve1"},{"id":"lxc/1001","type":"lxc","vmid":1001,"node":"pve1"}]}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/nodes/pve1/qemu":
+			body, _ := io.ReadAll(r.Body)
+			form, _ := url.ParseQuery(string(body))
+			vmid := form.Get("vmid")
+			tried = append(tried, vmid)
+			switch vmid {
+			case "1002":
+				writePVEError(t, w, 500, "unable to create VM 1002 - VM 1002 already exists on node 'pve2'")
+			default:
+				fmt.Fprintf(w, `{"data":"UPID:pve1:create%s"}`, vmid)
+			}
+		case r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:create1003/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"unable to create VM 1003 - VM 1003 already exists on node 'pve3'"}}`)
+		case r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:create1003/log":
+			fmt.Fprint(w, `{"data":[{"n":1,"t":"TASK ERROR: unable to create VM 1003 - VM 1003 already exists on node 'pve3'"}]}`)
+		case r.URL.Path == "/nodes/pve1/tasks/UPID:pve1:create1004/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer s.Close()
+	d := &Driver{
+		BaseDriver: &drivers.BaseDriver{MachineName: "test"},
+		Node:       "pve1",
+		VMIDRange:  "1000-1009",
+		client:     proxmox.NewClient(s.URL),
+	}
+
+	created, err := d.createVM(context.Background(), d.client, qemu.CreateRequest{Node: "pve1"}, &createCheckpoint{})
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, 1004, d.VMID)
+	assert.Equal(t, []string{"1002", "1003", "1004"}, tried)
+}
+
+func TestVMIDAllocatorWraps(t *testing.T) {
+	a := &vmidAllocator{min: 100, max: 102, next: 102, used: map[int]bool{100: true}}
+	for _, want := range []int{102, 101} {
+		id, err := a.take()
+		require.NoError(t, err)
+		assert.Equal(t, want, id)
+	}
+	_, err := a.take()
+	assert.Error(t, err)
+}
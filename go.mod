@@ -8,6 +8,7 @@ require (
 	github.com/docker/machine v0.16.2
 	github.com/labstack/gommon v0.4.2
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/crypto v0.18.0
 )
 
 require (
@@ -26,7 +27,6 @@ require (
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
 	github.com/vincent-petithory/dataurl v1.0.0 // indirect
-	golang.org/x/crypto v0.18.0 // indirect
 	golang.org/x/sys v0.16.0 // indirect
 	golang.org/x/term v0.16.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
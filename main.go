@@ -1,10 +1,22 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/FreekingDean/docker-machine-driver-proxmoxve/driver"
 	"github.com/docker/machine/libmachine/drivers/plugin"
 )
 
 func main() {
+	// docker-machine runs the plugin without arguments, anything else is one
+	// of our maintenance commands
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	plugin.RegisterDriver(driver.NewDriver("default", ""))
 }